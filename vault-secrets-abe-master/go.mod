@@ -10,4 +10,5 @@ require (
 	github.com/hashicorp/vault/api v1.1.0
 	github.com/hashicorp/vault/sdk v0.2.0
 	github.com/patrickmn/go-cache v2.1.0+incompatible
+	golang.org/x/crypto v0.0.0-20200604202706-70a84ac30bf9
 )
@@ -0,0 +1,183 @@
+package abe
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/helper/jsonutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// attributeIndex keeps the published keys of every attribute in memory, keyed by the name the attribute takes in a
+// policy (ATTRIBUTE for common and system attributes, ATTRIBUTE[AUTHORITY] for authority attributes).
+// The map is never modified once published: updates replace it with a copy, so readers can use it without locking.
+type attributeIndex struct {
+	sync.RWMutex
+
+	// keys is nil until the index has been loaded from the storage
+	keys map[string]keysData
+	// generation is increased by every update, so that a scan that raced with an update is not published
+	generation uint64
+}
+
+// allAttributesPutTogether returns the published keys of every attribute, loading the index on first use.
+// The returned map must not be modified.
+func (b *backend) allAttributesPutTogether(ctx context.Context, req *logical.Request) (map[string]keysData, error) {
+	b.attributeIndex.RLock()
+	keys := b.attributeIndex.keys
+	b.attributeIndex.RUnlock()
+
+	if keys != nil {
+		return keys, nil
+	}
+
+	return b.loadAttributeIndex(ctx)
+}
+
+// loadAttributeIndex (re)builds the index from the storage
+func (b *backend) loadAttributeIndex(ctx context.Context) (map[string]keysData, error) {
+	b.attributeIndex.RLock()
+	generation := b.attributeIndex.generation
+	b.attributeIndex.RUnlock()
+
+	keys, err := b.scanAttributeKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	b.attributeIndex.Lock()
+	if b.attributeIndex.generation == generation {
+		b.attributeIndex.keys = keys
+	}
+	b.attributeIndex.Unlock()
+
+	return keys, nil
+}
+
+// indexAttributeKey adds or replaces the published keys of an attribute in the index
+func (b *backend) indexAttributeKey(attribute string, published keysData) {
+	b.updateAttributeIndex(func(keys map[string]keysData) {
+		keys[attribute] = published
+	})
+	b.invalidateAttributeTables(attribute)
+}
+
+// unindexAttributeKey removes an attribute from the index
+func (b *backend) unindexAttributeKey(attribute string) {
+	b.updateAttributeIndex(func(keys map[string]keysData) {
+		delete(keys, attribute)
+	})
+	b.invalidateAttributeTables(attribute)
+}
+
+func (b *backend) updateAttributeIndex(update func(keys map[string]keysData)) {
+	b.attributeIndex.Lock()
+	defer b.attributeIndex.Unlock()
+
+	b.attributeIndex.generation++
+
+	// Not loaded yet: the next load reads the update from the storage
+	if b.attributeIndex.keys == nil {
+		return
+	}
+
+	keys := make(map[string]keysData, len(b.attributeIndex.keys)+1)
+	for attribute, published := range b.attributeIndex.keys {
+		keys[attribute] = published
+	}
+	update(keys)
+
+	b.attributeIndex.keys = keys
+}
+
+// indexedAttributeName returns the index name of the attribute whose published keys are stored at the given key
+// (AuthoritiesPath/<AUTHORITY>/<ATTRIBUTE>/PRIVATE_DATA, see dataKeyStore), or whose system attribute information
+// is stored at the given key (AuthoritiesPath/SYSTEM_ATTRIBUTES/<ATTRIBUTE>/CONFIG)
+func indexedAttributeName(storageKey string) (string, bool) {
+	segments := strings.Split(storageKey, "/")
+	if len(segments) != 4 || segments[0] != AuthoritiesPath {
+		return "", false
+	}
+
+	entry, attribute := segments[1], segments[2]
+	if segments[3] != privateAccessor && (entry != SystemAttributes || segments[3] != systemAttributeConfig) {
+		return "", false
+	}
+
+	if entry != SystemAttributes && entry != CommonAttributes {
+		attribute = attribute + "[" + strings.ToUpper(entry) + "]"
+	}
+
+	return attribute, true
+}
+
+// reindexAttributeKey refreshes a single attribute of the index from the storage
+func (b *backend) reindexAttributeKey(ctx context.Context, storageKey string) error {
+	attribute, ok := indexedAttributeName(storageKey)
+	if !ok {
+		return nil
+	}
+
+	segments := strings.Split(storageKey, "/")
+	publishedKey := strings.Join(append(segments[:3], privateAccessor), "/")
+
+	if segments[1] == SystemAttributes {
+		info, err := b.loadSystemAttributeInfo(ctx, segments[2])
+		if err != nil {
+			return err
+		}
+		if info != nil && info.Retired {
+			b.unindexAttributeKey(attribute)
+			return nil
+		}
+	}
+
+	out, err := b.storage.Get(ctx, publishedKey)
+	if err != nil {
+		return errwrap.Wrapf("read failed: {{err}}", err)
+	}
+
+	if out == nil {
+		b.unindexAttributeKey(attribute)
+		return nil
+	}
+
+	var published keysData
+	if err := jsonutil.DecodeJSON(out.Value, &published); err != nil {
+		return errwrap.Wrapf("json decoding failed: {{err}}", err)
+	}
+
+	b.indexAttributeKey(attribute, published)
+
+	return nil
+}
+
+// invalidate is called on performance standbys when the active node changes a storage entry, so that the
+// in-memory state of the backend follows the storage
+func (b *backend) invalidate(ctx context.Context, key string) {
+	switch {
+	case key == coreABEGroupKeyPath:
+		ecElement, g2Element, params, err := b.loadEC(ctx)
+		if err != nil || ecElement == nil {
+			b.Logger().Error("failed to reload the global parameters", "error", err)
+			return
+		}
+		b.cacheEC(ecElement, g2Element, params)
+	case key == performanceConfigPath:
+		b.abeCache.Delete(performanceConfigCache)
+	case strings.HasPrefix(key, keyConfigPath):
+		b.abeCache.Delete(keyConfigCache + strings.TrimPrefix(key, keyConfigPath))
+	case strings.HasPrefix(key, AuthoritiesPath+"/"):
+		if err := b.reindexAttributeKey(ctx, key); err != nil {
+			b.Logger().Error("failed to refresh the attribute index", "key", key, "error", err)
+
+			// Fall back to a full reload on next use
+			b.attributeIndex.Lock()
+			b.attributeIndex.keys = nil
+			b.attributeIndex.generation++
+			b.attributeIndex.Unlock()
+		}
+	}
+}
@@ -85,6 +85,11 @@ func (b *backend) authSetup(ctx context.Context, req *logical.Request, data *fra
 	commonAttrs := data.Get("commonAttributes").([]string)
 	authority := data.Get("authorityName").(string)
 
+	return b.setupAuthority(ctx, authority, authorityAttrs, commonAttrs)
+}
+
+// setupAuthority generates and stores the keys of new authority and common attributes, returning their public keys
+func (b *backend) setupAuthority(ctx context.Context, authority string, authorityAttrs []string, commonAttrs []string) (*logical.Response, error) {
 	if len(authorityAttrs) == 0 && len(commonAttrs) == 0 {
 		return logical.ErrorResponse("Wrong number of initialization attributes"), nil
 	}
@@ -139,6 +144,7 @@ func (b *backend) authSetup(ctx context.Context, req *logical.Request, data *fra
 	var publishedDataResponseAuthority []*keysDataAsResponse
 
 	ecElement := b.getABEElement()
+	generatorTables := b.getGeneratorTables()
 
 	for _, value := range mergedAttrs {
 		attribute := strings.ToUpper(value.attribute)
@@ -146,8 +152,8 @@ func (b *backend) authSetup(ctx context.Context, req *logical.Request, data *fra
 		alpha_i.Rand()
 		y_i.Rand()
 
-		e_gg_alpha_i := ecElement.Pairing().NewGT().Pair(ecElement, ecElement).ThenPowZn(alpha_i)
-		g_y_i := ecElement.Pairing().NewG1().Set(ecElement).ThenPowZn(y_i)
+		e_gg_alpha_i := ecElement.Pairing().NewGT().PowerZn(generatorTables.eggPower, alpha_i)
+		g_y_i := ecElement.Pairing().NewG2().PowerZn(generatorTables.hPower, y_i)
 
 		publishedData := &keysData{
 			Attribute: attribute,
@@ -175,16 +181,20 @@ func (b *backend) authSetup(ctx context.Context, req *logical.Request, data *fra
 		}
 
 		var constructedPath string
+		policyAttribute := attribute
 
 		if value.isCommon {
 			constructedPath = b.constructPath([]string{AuthoritiesPath, CommonAttributes})
 		} else {
 			constructedPath = b.constructPath([]string{AuthoritiesPath, authority})
+			policyAttribute = attribute + "[" + strings.ToUpper(authority) + "]"
 		}
 
 		if err := b.dataKeyStore(ctx, publishedData, privateData, constructedPath, attribute); err != nil {
 			return nil, errwrap.Wrapf("failed to import the new attributes: {{err}}", err)
 		}
+
+		b.indexAttributeKey(policyAttribute, *publishedData)
 	}
 
 	// Return the public keys only if there were no problems up till this point.
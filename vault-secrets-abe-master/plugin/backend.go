@@ -3,9 +3,11 @@ package abe
 import (
 	"context"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/logical"
 	cache "github.com/patrickmn/go-cache"
 )
@@ -54,6 +56,8 @@ func Backend(ctx context.Context, conf *logical.BackendConfig) (*backend, error)
 
 			Root: []string{
 				"config/*",
+				sysAttributesPath,
+				sysAttributesPath + "/*",
 			},
 
 			SealWrapStorage: []string{
@@ -63,23 +67,35 @@ func Backend(ctx context.Context, conf *logical.BackendConfig) (*backend, error)
 			},
 		},
 
-		Paths: framework.PathAppend(
+		Paths: b.requireInitialization(framework.PathAppend(
+			pathInit(&b),
+			pathConfig(&b),
+			pathCache(&b),
 			pathAuthSetup(&b),
 			pathAttributes(&b),
+			pathSystemAttributes(&b),
+			pathSysProposals(&b),
 			pathKeygenSetup(&b),
+			pathRevoke(&b),
+			pathKeys(&b),
 			pathEncrypt(&b),
 			pathSysDecrypt(&b),
 			pathFullDecrypt(&b),
+			pathDataKey(&b),
+			pathRewrap(&b),
+			pathPolicy(&b),
 			pathBuilderPath(&b),
-		),
+		)),
 
 		InitializeFunc: b.initializeABE,
+		Invalidate:     b.invalidate,
 
-		Secrets:     []*framework.Secret{},
+		Secrets: []*framework.Secret{},
 	}
 
-
 	b.abeCache = cache.New(0, 30*time.Second)
+	b.attributeLocks = locksutil.CreateLocks()
+	b.gidLocks = locksutil.CreateLocks()
 
 	b.crlLifetime = time.Hour * 72
 	b.tidyCASGuard = new(uint32)
@@ -89,12 +105,20 @@ func Backend(ctx context.Context, conf *logical.BackendConfig) (*backend, error)
 }
 
 type backend struct {
+	// precomputeStats is updated atomically and comes first to keep its counters 64-bit aligned
+	precomputeStats precomputeStats
+
 	*framework.Backend
 
-	storage      logical.Storage
-	abeCache     *cache.Cache
-	crlLifetime  time.Duration
-	tidyCASGuard *uint32
+	storage        logical.Storage
+	attributeIndex attributeIndex
+	proposalLock   sync.Mutex
+	initLock       sync.Mutex
+	attributeLocks []*locksutil.LockEntry
+	gidLocks       []*locksutil.LockEntry
+	abeCache       *cache.Cache
+	crlLifetime    time.Duration
+	tidyCASGuard   *uint32
 }
 
 const backendHelp = `
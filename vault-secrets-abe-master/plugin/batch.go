@@ -0,0 +1,70 @@
+package abe
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const batchInputDescription = "A list of items to process in one request. Each item takes the same fields as the request, and the fields it leaves out fall back to the ones of the request. Failed items are reported in their own `error` field."
+
+// parseBatchInput converts the `batch_input` field into a list of items, where every value must be a string
+func parseBatchInput(raw interface{}) ([]map[string]string, error) {
+	rawItems, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("batch_input must be a list")
+	}
+
+	items := make([]map[string]string, 0, len(rawItems))
+
+	for i, rawItem := range rawItems {
+		fields, ok := rawItem.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("item %d of batch_input is not an object", i)
+		}
+
+		item := make(map[string]string)
+		for field, value := range fields {
+			stringValue, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("field %s of item %d of batch_input must be a string", field, i)
+			}
+			item[field] = stringValue
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// batchItemValue returns the value of a field of an item, or the value given for the whole request
+func batchItemValue(item map[string]string, field string, fallback string) string {
+	if value, ok := item[field]; ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// batchItemResult turns the outcome of a single item into the result reported for it, so that a failed item
+// does not fail the rest of the batch
+func batchItemResult(itemData map[string]interface{}, resp *logical.Response, err error) map[string]interface{} {
+	if err != nil {
+		return map[string]interface{}{
+			"error": err.Error(),
+		}
+	}
+
+	if resp != nil {
+		result := make(map[string]interface{})
+		for key, value := range resp.Data {
+			result[key] = value
+		}
+		if _, ok := result["error"]; !ok {
+			result["error"] = "The item could not be processed"
+		}
+		return result
+	}
+
+	return itemData
+}
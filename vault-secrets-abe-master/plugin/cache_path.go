@@ -0,0 +1,29 @@
+package abe
+
+import (
+	"context"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func pathCache(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "cache/metrics",
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.readCacheMetrics,
+					Summary:  "Report the hits and misses of the precomputed pairing tables.",
+				},
+			},
+		},
+	}
+}
+
+func (b *backend) readCacheMetrics(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	return &logical.Response{
+		Data: b.precomputeMetrics(),
+	}, nil
+}
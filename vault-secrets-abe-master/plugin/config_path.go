@@ -0,0 +1,432 @@
+package abe
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	performanceConfigPath  = "config/performance"
+	performanceConfigCache = "performanceConfig"
+
+	maxWorkers = 256
+
+	revocationConfigPath = "config/revocation"
+
+	// paramsConfigPath keeps the pairing parameters chosen before the mount is initialized, for config/init
+	paramsConfigPath = "config/params"
+
+	rewrapConfigPath = "config/rewrap"
+
+	// previousVersionsDecryptOnly keeps the previous versions of the keys of a rotated attribute, for the existing cryptograms
+	previousVersionsDecryptOnly = "decrypt_only"
+	// previousVersionsDisabled deletes the previous versions of the keys of a rotated attribute
+	previousVersionsDisabled = "disabled"
+)
+
+type performanceConfig struct {
+	Workers int `json:"workers"`
+}
+
+type revocationConfig struct {
+	PreviousVersions string `json:"previous_versions"`
+}
+
+type paramsConfig struct {
+	ParamSet string `json:"param_set"`
+	Params   string `json:"params,omitempty"`
+}
+
+type rewrapConfig struct {
+	AllowPolicyChange bool `json:"allow_policy_change"`
+}
+
+func pathConfig(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "config/performance",
+
+			Fields: map[string]*framework.FieldSchema{
+				"workers": {
+					Type:        framework.TypeInt,
+					Description: fmt.Sprintf("The number of attributes processed in parallel by encrypt and decrypt (1 to %d; 1 disables the parallelism). Defaults to the number of CPUs.", maxWorkers),
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.readPerformanceConfig,
+					Summary:  "Read the performance settings of the mount.",
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.writePerformanceConfig,
+					Summary:  "Configure the performance settings of the mount.",
+				},
+			},
+		},
+		{
+			Pattern: paramsConfigPath,
+
+			Fields: map[string]*framework.FieldSchema{
+				"param_set": {
+					Type:        framework.TypeString,
+					Description: fmt.Sprintf("The pairing parameter set (%s)", strings.Join(supportedParamSets, ", ")),
+					Default:     defaultParamSet,
+				},
+				"params": {
+					Type:        framework.TypeString,
+					Description: "The PBC parameters, in the format of the PBC library (only for the `custom` parameter set)",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback:    b.readParamsConfig,
+					Summary:     "Read the pairing parameters of the mount.",
+					Description: "Before the mount is initialized, the parameters chosen for " + initPath + " are returned.",
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback:    b.writeParamsConfig,
+					Summary:     "Choose the pairing parameters the mount is initialized with.",
+					Description: "The parameters are used by " + initPath + " unless it is given a param_set. Every key and cryptogram depends on them, so they can not be changed once the mount is initialized.",
+				},
+			},
+		},
+		{
+			Pattern: revocationConfigPath,
+
+			Fields: map[string]*framework.FieldSchema{
+				"previous_versions": {
+					Type:        framework.TypeString,
+					Description: fmt.Sprintf("What happens to the previous version of the keys of an attribute when it is rotated by a revocation: `%s` (the remaining holders keep decrypting the existing cryptograms) or `%s` (the existing cryptograms can no longer be decrypted)", previousVersionsDecryptOnly, previousVersionsDisabled),
+					Default:     previousVersionsDecryptOnly,
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.readRevocationConfig,
+					Summary:  "Read the revocation settings of the mount.",
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.writeRevocationConfig,
+					Summary:  "Configure the revocation settings of the mount.",
+				},
+			},
+		},
+		{
+			Pattern: rewrapConfigPath,
+
+			Fields: map[string]*framework.FieldSchema{
+				"allow_policy_change": {
+					Type:        framework.TypeBool,
+					Description: "Whether rewrap may encrypt a cryptogram under a policy other than its own. Whoever may rewrap can then give the plaintext of any cryptogram to the holders of any policy, so it is disabled by default.",
+					Default:     false,
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.readRewrapConfig,
+					Summary:  "Read the rewrap settings of the mount.",
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.writeRewrapConfig,
+					Summary:  "Configure the rewrap settings of the mount.",
+				},
+			},
+		},
+	}
+}
+
+func (b *backend) readParamsConfig(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	entry, err := req.Storage.Get(ctx, coreABEGroupKeyPath)
+	if err != nil {
+		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+	}
+	if entry == nil {
+		config, err := b.getParamsConfig(ctx, req.Storage)
+		if err != nil || config == nil {
+			return nil, err
+		}
+
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"param_set":   config.ParamSet,
+				"params":      config.Params,
+				"initialized": false,
+			},
+		}, nil
+	}
+
+	var ecData encodedG
+	if err := entry.DecodeJSON(&ecData); err != nil {
+		return nil, errwrap.Wrapf("json decoding failed: {{err}}", err)
+	}
+
+	paramSet := ecData.ParamSet
+	if paramSet == "" {
+		paramSet = paramSetA512
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"param_set":   paramSet,
+			"params":      string(ecData.Params),
+			"params_hash": hex.EncodeToString(paramsHash(ecData.Params)),
+			"symmetric":   len(ecData.EncodedH) == 0,
+			"initialized": true,
+		},
+	}, nil
+}
+
+// writeParamsConfig chooses the pairing parameters config/init generates the global parameters with. They can not be changed
+// once the mount is initialized: the keys of the system attributes, every version of them included, and the cryptograms depend on them.
+func (b *backend) writeParamsConfig(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	// config/init reads the chosen parameters under the same lock
+	b.initLock.Lock()
+	defer b.initLock.Unlock()
+
+	entry, err := req.Storage.Get(ctx, coreABEGroupKeyPath)
+	if err != nil {
+		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+	}
+	if entry != nil {
+		return logical.ErrorResponse("The pairing parameters can not be changed once the mount is initialized"), nil
+	}
+
+	config := paramsConfig{
+		ParamSet: strings.ToLower(data.Get("param_set").(string)),
+		Params:   data.Get("params").(string),
+	}
+
+	if err := config.check(); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Invalid pairing parameters: %s", err)), nil
+	}
+
+	entry, err = logical.StorageEntryJSON(paramsConfigPath, config)
+	if err != nil {
+		return nil, errwrap.Wrapf("json encoding failed: {{err}}", err)
+	}
+
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, errwrap.Wrapf("failed to write: {{err}}", err)
+	}
+
+	return nil, nil
+}
+
+// check validates the choice without generating the parameters, which may take a few seconds for the generated sets
+func (config paramsConfig) check() error {
+	if config.Params != "" && config.ParamSet != paramSetCustom {
+		return fmt.Errorf("params can only be given with the %s parameter set", paramSetCustom)
+	}
+
+	if !sliceContains(supportedParamSets, config.ParamSet) {
+		return fmt.Errorf("unsupported parameter set %q (supported: %v)", config.ParamSet, supportedParamSets)
+	}
+	if config.ParamSet != paramSetCustom {
+		return nil
+	}
+
+	params, err := generateParams(config.ParamSet, config.Params)
+	if err != nil {
+		return err
+	}
+
+	return checkParamSet(config.ParamSet, params.NewPairing())
+}
+
+// getParamsConfig returns the pairing parameters chosen for config/init, or nil if none have been chosen
+func (b *backend) getParamsConfig(ctx context.Context, storage logical.Storage) (*paramsConfig, error) {
+	entry, err := storage.Get(ctx, paramsConfigPath)
+	if err != nil {
+		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var config paramsConfig
+	if err := entry.DecodeJSON(&config); err != nil {
+		return nil, errwrap.Wrapf("json decoding failed: {{err}}", err)
+	}
+
+	return &config, nil
+}
+
+func (b *backend) readPerformanceConfig(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := b.getPerformanceConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"workers": config.Workers,
+		},
+	}, nil
+}
+
+func (b *backend) writePerformanceConfig(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := b.getPerformanceConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if workers, ok := data.GetOk("workers"); ok {
+		config.Workers = workers.(int)
+	}
+
+	if config.Workers < 1 || config.Workers > maxWorkers {
+		return logical.ErrorResponse(fmt.Sprintf("workers must be between 1 and %d", maxWorkers)), nil
+	}
+
+	entry, err := logical.StorageEntryJSON(performanceConfigPath, config)
+	if err != nil {
+		return nil, errwrap.Wrapf("json encoding failed: {{err}}", err)
+	}
+
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, errwrap.Wrapf("failed to write: {{err}}", err)
+	}
+
+	b.abeCache.SetDefault(performanceConfigCache, config)
+
+	return nil, nil
+}
+
+// getPerformanceConfig returns the performance settings of the mount, or the defaults if none have been written
+func (b *backend) getPerformanceConfig(ctx context.Context, storage logical.Storage) (performanceConfig, error) {
+	if cached, exists := b.abeCache.Get(performanceConfigCache); exists {
+		return cached.(performanceConfig), nil
+	}
+
+	config := performanceConfig{
+		Workers: runtime.NumCPU(),
+	}
+
+	entry, err := storage.Get(ctx, performanceConfigPath)
+	if err != nil {
+		return config, errwrap.Wrapf("read failed: {{err}}", err)
+	}
+
+	if entry != nil {
+		if err := entry.DecodeJSON(&config); err != nil {
+			return config, errwrap.Wrapf("json decoding failed: {{err}}", err)
+		}
+	}
+
+	b.abeCache.SetDefault(performanceConfigCache, config)
+
+	return config, nil
+}
+
+func (b *backend) readRevocationConfig(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := b.getRevocationConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"previous_versions": config.PreviousVersions,
+		},
+	}, nil
+}
+
+func (b *backend) writeRevocationConfig(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config := revocationConfig{
+		PreviousVersions: strings.ToLower(data.Get("previous_versions").(string)),
+	}
+
+	if config.PreviousVersions != previousVersionsDecryptOnly && config.PreviousVersions != previousVersionsDisabled {
+		return logical.ErrorResponse(fmt.Sprintf("Unsupported previous_versions %s (supported: %s, %s)", config.PreviousVersions, previousVersionsDecryptOnly, previousVersionsDisabled)), nil
+	}
+
+	entry, err := logical.StorageEntryJSON(revocationConfigPath, config)
+	if err != nil {
+		return nil, errwrap.Wrapf("json encoding failed: {{err}}", err)
+	}
+
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, errwrap.Wrapf("failed to write: {{err}}", err)
+	}
+
+	return nil, nil
+}
+
+// getRevocationConfig returns the revocation settings of the mount, or the defaults if none have been written
+func (b *backend) getRevocationConfig(ctx context.Context) (revocationConfig, error) {
+	config := revocationConfig{
+		PreviousVersions: previousVersionsDecryptOnly,
+	}
+
+	entry, err := b.storage.Get(ctx, revocationConfigPath)
+	if err != nil {
+		return config, errwrap.Wrapf("read failed: {{err}}", err)
+	}
+
+	if entry != nil {
+		if err := entry.DecodeJSON(&config); err != nil {
+			return config, errwrap.Wrapf("json decoding failed: {{err}}", err)
+		}
+	}
+
+	return config, nil
+}
+
+func (b *backend) readRewrapConfig(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := b.getRewrapConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"allow_policy_change": config.AllowPolicyChange,
+		},
+	}, nil
+}
+
+func (b *backend) writeRewrapConfig(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config := rewrapConfig{
+		AllowPolicyChange: data.Get("allow_policy_change").(bool),
+	}
+
+	entry, err := logical.StorageEntryJSON(rewrapConfigPath, config)
+	if err != nil {
+		return nil, errwrap.Wrapf("json encoding failed: {{err}}", err)
+	}
+
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, errwrap.Wrapf("failed to write: {{err}}", err)
+	}
+
+	return nil, nil
+}
+
+// getRewrapConfig returns the rewrap settings of the mount, or the defaults if none have been written
+func (b *backend) getRewrapConfig(ctx context.Context, storage logical.Storage) (rewrapConfig, error) {
+	var config rewrapConfig
+
+	entry, err := storage.Get(ctx, rewrapConfigPath)
+	if err != nil {
+		return config, errwrap.Wrapf("read failed: {{err}}", err)
+	}
+
+	if entry != nil {
+		if err := entry.DecodeJSON(&config); err != nil {
+			return config, errwrap.Wrapf("json decoding failed: {{err}}", err)
+		}
+	}
+
+	return config, nil
+}
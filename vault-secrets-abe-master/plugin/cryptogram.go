@@ -0,0 +1,248 @@
+package abe
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Nik-U/pbc"
+	"github.com/hashicorp/errwrap"
+)
+
+const (
+	// cryptogramPrefix marks the versioned cryptograms; legacy (v1) cryptograms are plain base64 encoded JSON
+	cryptogramPrefix = "vault:abe:"
+
+	cryptogramVersionLegacy = 1
+	cryptogramVersion       = 2
+
+	// kdfLegacySHA256 derives the symmetric key as SHA-256 over the decimal string of the GT element
+	kdfLegacySHA256 = "sha256-decimal"
+	// kdfHKDFSHA256 derives the symmetric key with HKDF-SHA256 over the canonical bytes of the GT element,
+	// with a per-cryptogram salt
+	kdfHKDFSHA256 = "hkdf-sha256"
+
+	initialKeyVersion = 1
+
+	cryptogramFormatJSON   = "json"
+	cryptogramFormatBinary = "binary"
+
+	// binaryFormatTag follows the version in the envelope prefix of binary cryptograms (e.g. `vault:abe:v2b:`)
+	binaryFormatTag = "b"
+)
+
+func paramsHash(params []byte) []byte {
+	hash := sha256.Sum256(params)
+	return hash[:]
+}
+
+func (b *backend) getParamsHash() []byte {
+
+	hash, exists := b.abeCache.Get(abeParamsHashCache)
+
+	if !exists {
+		return nil
+	}
+
+	return hash.([]byte)
+}
+
+// keyVersion returns the version of the keys, the keys stored before they were versioned being the initial version
+func (data keysData) keyVersion() int {
+	if data.Version == 0 {
+		return initialKeyVersion
+	}
+	return data.Version
+}
+
+// newCryptogramHeader describes a cryptogram that is about to be produced for the given attributes,
+// recording the version of the published keys of each of them
+func (b *backend) newCryptogramHeader(cipherType string, attributes []string, attributesList map[string]keysData) (*cryptogramHeader, error) {
+	keyVersions := make(map[string]int)
+	for _, attribute := range attributes {
+		attribute = strings.ToUpper(attribute)
+		keyVersions[attribute] = attributesList[attribute].keyVersion()
+	}
+
+	salt := make([]byte, kdfSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	return &cryptogramHeader{
+		Version:     cryptogramVersion,
+		Cipher:      cipherType,
+		KDF:         kdfHKDFSHA256,
+		KDFSalt:     salt,
+		ParamsHash:  b.getParamsHash(),
+		KeyVersions: keyVersions,
+	}, nil
+}
+
+// keyVersion returns the version of the keys the attribute was encrypted with
+func (cts *cryptogram) keyVersion(attribute string) int {
+	if cts.Header == nil || cts.Header.KeyVersions[strings.ToUpper(attribute)] == 0 {
+		return initialKeyVersion
+	}
+	return cts.Header.KeyVersions[strings.ToUpper(attribute)]
+}
+
+func (cts *cryptogram) version() int {
+	if cts.Header == nil {
+		return cryptogramVersionLegacy
+	}
+	return cts.Header.Version
+}
+
+// cipherType returns the symmetric cipher of the payload (legacy cryptograms only know AES-CBC)
+func (cts *cryptogram) cipherType() string {
+	if cts.Header == nil {
+		return cipherAES256CBC
+	}
+	return cts.Header.Cipher
+}
+
+func (cts *cryptogram) kdf() string {
+	if cts.Header == nil {
+		return kdfLegacySHA256
+	}
+	return cts.Header.KDF
+}
+
+// symmetricKey derives the key of the payload from the GT element that the ABE layer protects
+func (cts *cryptogram) symmetricKey(element *pbc.Element) ([]byte, error) {
+	var salt []byte
+	if cts.Header != nil {
+		salt = cts.Header.KDFSalt
+	}
+	return deriveSymmetricKey(cts.kdf(), element, salt)
+}
+
+func (b *backend) encodeCryptogram(cts cryptogram) (string, error) {
+	if cts.format == cryptogramFormatBinary {
+		if cts.version() == cryptogramVersionLegacy {
+			return "", fmt.Errorf("legacy cryptograms can not be encoded in the binary format")
+		}
+
+		exported, err := b.marshalCryptogramBinary(cts)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("%sv%d%s:%s", cryptogramPrefix, cts.version(), binaryFormatTag, b64.StdEncoding.EncodeToString(exported)), nil
+	}
+
+	exported, err := json.Marshal(cts)
+	if err != nil {
+		return "", err
+	}
+
+	b64Encoded := b64.StdEncoding.EncodeToString(exported)
+
+	if cts.version() == cryptogramVersionLegacy {
+		return b64Encoded, nil
+	}
+
+	return fmt.Sprintf("%sv%d:%s", cryptogramPrefix, cts.version(), b64Encoded), nil
+}
+
+// decodeCryptogram dispatches on the envelope prefix: `vault:abe:v2:<base64 JSON>`, `vault:abe:v2b:<base64 binary>`
+// or plain base64 JSON for legacy cryptograms
+func (b *backend) decodeCryptogram(encoded string) (cryptogram, error) {
+	var cts cryptogram
+
+	version := cryptogramVersionLegacy
+	format := cryptogramFormatJSON
+	encoded = strings.TrimSpace(encoded)
+
+	if strings.HasPrefix(encoded, cryptogramPrefix) {
+		parts := strings.SplitN(strings.TrimPrefix(encoded, cryptogramPrefix), ":", 2)
+		if len(parts) != 2 {
+			return cts, fmt.Errorf("malformed cryptogram envelope")
+		}
+
+		switch parts[0] {
+		case fmt.Sprintf("v%d", cryptogramVersion):
+		case fmt.Sprintf("v%d%s", cryptogramVersion, binaryFormatTag):
+			format = cryptogramFormatBinary
+		default:
+			return cts, fmt.Errorf("unsupported cryptogram version %q", parts[0])
+		}
+		version = cryptogramVersion
+		encoded = parts[1]
+	}
+
+	decoded, err := b64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return cts, errwrap.Wrapf("base64 decoding failed: {{err}}", err)
+	}
+
+	if format == cryptogramFormatBinary {
+		if cts, err = b.unmarshalCryptogramBinary(decoded); err != nil {
+			return cts, errwrap.Wrapf("binary decoding failed: {{err}}", err)
+		}
+	} else if err := json.Unmarshal(decoded, &cts); err != nil {
+		return cts, errwrap.Wrapf("json decoding failed: {{err}}", err)
+	} else if err := b.checkCryptogramComponents(cts); err != nil {
+		return cts, errwrap.Wrapf("json decoding failed: {{err}}", err)
+	}
+	cts.format = format
+
+	if cts.version() != version {
+		return cts, fmt.Errorf("the cryptogram header does not match its envelope version")
+	}
+
+	if version != cryptogramVersionLegacy {
+		if paramsHash := b.getParamsHash(); paramsHash != nil && string(cts.Header.ParamsHash) != string(paramsHash) {
+			return cts, fmt.Errorf("the cryptogram was produced with different pairing parameters")
+		}
+	}
+
+	return cts, nil
+}
+
+// checkCryptogramComponents checks that the cryptogram has the components of every leaf of its policy,
+// and that its GT and G2 elements have the length of the pairing, so that they are never decoded from short or missing bytes
+func (b *backend) checkCryptogramComponents(cts cryptogram) error {
+	pairing := b.getABEElement().Pairing()
+	gtLength, g2Length := int(pairing.GTLength()), int(pairing.G2Length())
+
+	if len(cts.C0) != gtLength {
+		return fmt.Errorf("C0 is %d bytes long instead of %d", len(cts.C0), gtLength)
+	}
+
+	policy, err := createPolicy(cts.PolicyStr)
+	if err != nil {
+		return errwrap.Wrapf("invalid policy: {{err}}", err)
+	}
+
+	for _, attribute := range policy.getAttributeList() {
+		if cts.C1[attribute] == nil || cts.C2[attribute] == nil || cts.C3[attribute] == nil {
+			return fmt.Errorf("the components of %s are missing", attribute)
+		}
+	}
+
+	for attribute, C1 := range cts.C1 {
+		if len(C1) != gtLength {
+			return fmt.Errorf("C1 of %s is %d bytes long instead of %d", attribute, len(C1), gtLength)
+		}
+		if len(cts.C2[attribute]) != g2Length || len(cts.C3[attribute]) != g2Length {
+			return fmt.Errorf("C2 or C3 of %s is not %d bytes long", attribute, g2Length)
+		}
+	}
+
+	if len(cts.SysDecrypted) > 0 && len(cts.SysDecrypted) != gtLength {
+		return fmt.Errorf("SysDecrypted is %d bytes long instead of %d", len(cts.SysDecrypted), gtLength)
+	}
+	for attribute, part := range cts.SysDecryptedAttr {
+		if len(part) != gtLength {
+			return fmt.Errorf("the system decryption of %s is %d bytes long instead of %d", attribute, len(part), gtLength)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,210 @@
+package abe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+)
+
+// The binary layout of a cryptogram is a sequence of fields, each one prefixed by its length as an uvarint:
+//
+//	header (JSON) | policy | C0 | number of attributes | { attribute | C1 | C2 | C3 } | SysDecrypted | CipherIV | EncryptedMessage
+//	[ number of system attributes | { attribute | SysDecryptedAttr } ]
+//
+// The last section is only present once `sysdecrypt` has computed the parts of the system attributes.
+// C2 and C3 are G2 points (G1 for symmetric pairings), so they are stored compressed; C0 and C1 are GT elements and are stored as is.
+
+var errTruncatedCryptogram = errors.New("truncated cryptogram")
+
+type binaryWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *binaryWriter) writeUvarint(value uint64) {
+	var length [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(length[:], value)
+	w.buf.Write(length[:n])
+}
+
+func (w *binaryWriter) writeField(field []byte) {
+	w.writeUvarint(uint64(len(field)))
+	w.buf.Write(field)
+}
+
+type binaryReader struct {
+	r *bytes.Reader
+}
+
+func (r *binaryReader) readUvarint() (uint64, error) {
+	value, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return 0, errTruncatedCryptogram
+	}
+	return value, nil
+}
+
+func (r *binaryReader) readField() ([]byte, error) {
+	length, err := r.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(r.r.Len()) {
+		return nil, errTruncatedCryptogram
+	}
+
+	field := make([]byte, length)
+	if _, err := io.ReadFull(r.r, field); err != nil {
+		return nil, errTruncatedCryptogram
+	}
+	return field, nil
+}
+
+func (b *backend) marshalCryptogramBinary(cts cryptogram) ([]byte, error) {
+	ecElement := b.getABEElement()
+
+	header, err := json.Marshal(cts.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &binaryWriter{}
+
+	w.writeField(header)
+	w.writeField([]byte(cts.PolicyStr))
+	w.writeField(cts.C0)
+
+	attributes := make([]string, 0, len(cts.C1))
+	for attribute := range cts.C1 {
+		attributes = append(attributes, attribute)
+	}
+	sort.Strings(attributes)
+
+	w.writeUvarint(uint64(len(attributes)))
+	for _, attribute := range attributes {
+		w.writeField([]byte(attribute))
+		w.writeField(cts.C1[attribute])
+		w.writeField(ecElement.Pairing().NewG2().SetBytes(cts.C2[attribute]).CompressedBytes())
+		w.writeField(ecElement.Pairing().NewG2().SetBytes(cts.C3[attribute]).CompressedBytes())
+	}
+
+	w.writeField(cts.SysDecrypted)
+	w.writeField(cts.CipherIV)
+	w.writeField(cts.EncryptedMessage)
+
+	if len(cts.SysDecryptedAttr) > 0 {
+		sysAttributes := make([]string, 0, len(cts.SysDecryptedAttr))
+		for attribute := range cts.SysDecryptedAttr {
+			sysAttributes = append(sysAttributes, attribute)
+		}
+		sort.Strings(sysAttributes)
+
+		w.writeUvarint(uint64(len(sysAttributes)))
+		for _, attribute := range sysAttributes {
+			w.writeField([]byte(attribute))
+			w.writeField(cts.SysDecryptedAttr[attribute])
+		}
+	}
+
+	return w.buf.Bytes(), nil
+}
+
+func (b *backend) unmarshalCryptogramBinary(data []byte) (cryptogram, error) {
+	var cts cryptogram
+	var err error
+
+	ecElement := b.getABEElement()
+	r := &binaryReader{r: bytes.NewReader(data)}
+
+	header, err := r.readField()
+	if err != nil {
+		return cts, err
+	}
+	if err := json.Unmarshal(header, &cts.Header); err != nil {
+		return cts, err
+	}
+
+	policy, err := r.readField()
+	if err != nil {
+		return cts, err
+	}
+	cts.PolicyStr = string(policy)
+
+	if cts.C0, err = r.readField(); err != nil {
+		return cts, err
+	}
+
+	count, err := r.readUvarint()
+	if err != nil {
+		return cts, err
+	}
+	if count > uint64(r.r.Len()) {
+		return cts, errTruncatedCryptogram
+	}
+
+	cts.C1, cts.C2, cts.C3 = make(map[string][]byte), make(map[string][]byte), make(map[string][]byte)
+
+	for i := uint64(0); i < count; i++ {
+		var fields [4][]byte
+		for j := range fields {
+			if fields[j], err = r.readField(); err != nil {
+				return cts, err
+			}
+		}
+
+		if len(fields[2]) != int(ecElement.Pairing().G2CompressedLength()) || len(fields[3]) != int(ecElement.Pairing().G2CompressedLength()) {
+			return cts, errors.New("invalid compressed point")
+		}
+
+		attribute := string(fields[0])
+		cts.C1[attribute] = fields[1]
+		cts.C2[attribute] = ecElement.Pairing().NewG2().SetCompressedBytes(fields[2]).Bytes()
+		cts.C3[attribute] = ecElement.Pairing().NewG2().SetCompressedBytes(fields[3]).Bytes()
+	}
+
+	if cts.SysDecrypted, err = r.readField(); err != nil {
+		return cts, err
+	}
+	if len(cts.SysDecrypted) == 0 {
+		cts.SysDecrypted = nil
+	}
+	if cts.CipherIV, err = r.readField(); err != nil {
+		return cts, err
+	}
+	if cts.EncryptedMessage, err = r.readField(); err != nil {
+		return cts, err
+	}
+
+	if r.r.Len() > 0 {
+		sysCount, err := r.readUvarint()
+		if err != nil {
+			return cts, err
+		}
+		if sysCount > uint64(r.r.Len()) {
+			return cts, errTruncatedCryptogram
+		}
+
+		cts.SysDecryptedAttr = make(map[string][]byte)
+		for i := uint64(0); i < sysCount; i++ {
+			attribute, err := r.readField()
+			if err != nil {
+				return cts, err
+			}
+			if cts.SysDecryptedAttr[string(attribute)], err = r.readField(); err != nil {
+				return cts, err
+			}
+		}
+	}
+
+	if r.r.Len() != 0 {
+		return cts, errors.New("trailing data after the cryptogram")
+	}
+
+	if err := b.checkCryptogramComponents(cts); err != nil {
+		return cts, err
+	}
+
+	return cts, nil
+}
@@ -0,0 +1,173 @@
+package abe
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	dataKeyPlaintext = "plaintext"
+	dataKeyWrapped   = "wrapped"
+)
+
+func pathDataKey(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "datakey/decrypt/" + framework.GenericNameRegex("entity_id"),
+
+			Fields: map[string]*framework.FieldSchema{
+				"entity_id": {
+					Type:        framework.TypeString,
+					Description: "[Required] Name of the subject",
+				},
+				"cryptogram": {
+					Type:        framework.TypeString,
+					Description: "The cryptogram that wraps the data key",
+					Required:    true,
+				},
+				"sub_policy": {
+					Type:        framework.TypeString,
+					Description: "[Required] The policy to use for the decryption",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.decryptDataKey,
+					Summary:  "Recover the data key wrapped in a cryptogram.",
+				},
+			},
+		},
+		{
+			Pattern: "datakey/" + framework.GenericNameRegex("type"),
+
+			Fields: map[string]*framework.FieldSchema{
+				"type": {
+					Type:        framework.TypeString,
+					Description: "`plaintext` returns the data key together with the cryptogram that wraps it, `wrapped` returns only the cryptogram",
+				},
+				"policy": {
+					Type:        framework.TypeString,
+					Description: "The policy under which the data key is wrapped",
+					Required:    true,
+				},
+				"format": {
+					Type:        framework.TypeString,
+					Description: "The encoding of the cryptogram (`json`, or `binary` for a compact encoding with compressed points)",
+					Default:     cryptogramFormatJSON,
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.generateDataKey,
+					Summary:  "Generate a data key wrapped under a policy, for client-side encryption.",
+				},
+			},
+		},
+	}
+}
+
+func (b *backend) generateDataKey(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Info("Invoked: Data key generation")
+
+	dataKeyType := strings.ToLower(data.Get("type").(string))
+	policy_str := data.Get("policy").(string)
+	format := strings.ToLower(data.Get("format").(string))
+
+	if dataKeyType != dataKeyPlaintext && dataKeyType != dataKeyWrapped {
+		return logical.ErrorResponse(fmt.Sprintf("Unsupported data key type %s (supported: %s, %s)", dataKeyType, dataKeyPlaintext, dataKeyWrapped)), nil
+	}
+
+	if format != cryptogramFormatJSON && format != cryptogramFormatBinary {
+		return logical.ErrorResponse(fmt.Sprintf("Unsupported format %s (supported: %s, %s)", format, cryptogramFormatJSON, cryptogramFormatBinary)), nil
+	}
+
+	policy, err := createPolicy(policy_str)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Invalid policy: %s", err)), nil
+	}
+
+	attributesList, err := b.allAttributesPutTogether(ctx, req)
+	if err != nil {
+		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+	}
+
+	config, err := b.getPerformanceConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	// The cryptogram carries no payload: the data key is used by the client
+	generatedData, dataKey, resp, err := b.encapsulate(ctx, policy, policy_str, cipherNone, attributesList, config.Workers)
+	if err != nil || resp != nil {
+		return resp, err
+	}
+	generatedData.format = format
+
+	b64Encoded, err := b.encodeCryptogram(*generatedData)
+	if err != nil {
+		return nil, err
+	}
+
+	response := map[string]interface{}{
+		"ciphertext": b64Encoded,
+	}
+
+	if dataKeyType == dataKeyPlaintext {
+		response["plaintext"] = b64.StdEncoding.EncodeToString(dataKey)
+	}
+
+	return &logical.Response{
+		Data: response,
+	}, nil
+}
+
+func (b *backend) decryptDataKey(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Info("Invoked: Data key decryption")
+
+	GID := data.Get("entity_id").(string)
+	sub_policy_str := data.Get("sub_policy").(string)
+
+	sub_policy, err := createPolicy(sub_policy_str)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Invalid sub_policy: %s", err)), nil
+	}
+
+	cts, err := b.decodeCryptogram(data.Get("cryptogram").(string))
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Invalid cryptogram: %s", err)), nil
+	}
+
+	policy, err := createPolicy(cts.PolicyStr)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Invalid cryptogram policy: %s", err)), nil
+	}
+
+	config, err := b.getPerformanceConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	GIDData, err := b.loadGIDData(ctx, req, GID)
+	if err != nil {
+		return nil, errwrap.Wrapf("Error with GID data: {{err}}", err)
+	}
+
+	dataKey, resp, err := b.decapsulate(ctx, GID, GIDData, sub_policy, policy, &cts, config.Workers)
+	if err != nil || resp != nil {
+		return resp, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"plaintext": b64.StdEncoding.EncodeToString(dataKey),
+		},
+	}, nil
+}
@@ -2,18 +2,12 @@ package abe
 
 import (
 	"context"
-	"crypto/aes"
-	cbc "crypto/cipher"
-	"crypto/rand"
-	"crypto/sha256"
-	"encoding/json"
+	b64 "encoding/base64"
 	"fmt"
-	"io"
 	"math/big"
+	"sort"
 	"strings"
 
-	b64 "encoding/base64"
-
 	"github.com/Nik-U/pbc"
 	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/sdk/framework"
@@ -28,12 +22,30 @@ func pathEncrypt(b *backend) []*framework.Path {
 			Fields: map[string]*framework.FieldSchema{
 				"message": {
 					Type:        framework.TypeString,
-					Description: "Specifies the path of the secret.",
+					Description: "The (UTF-8) message to encrypt. Either `message` or `plaintext` must be given.",
+				},
+				"plaintext": {
+					Type:        framework.TypeString,
+					Description: "The base64 encoded data to encrypt, for binary payloads. Either `message` or `plaintext` must be given.",
 				},
 				"policy": {
 					Type:        framework.TypeString,
 					Description: "Specifies the path of the secret.",
 				},
+				"cipher": {
+					Type:        framework.TypeString,
+					Description: "The AEAD that encrypts the message (`aes256-gcm96` or `chacha20-poly1305`)",
+					Default:     defaultCipher,
+				},
+				"format": {
+					Type:        framework.TypeString,
+					Description: "The encoding of the cryptogram (`json`, or `binary` for a compact encoding with compressed points)",
+					Default:     cryptogramFormatJSON,
+				},
+				"batch_input": {
+					Type:        framework.TypeSlice,
+					Description: batchInputDescription,
+				},
 			},
 
 			Operations: map[logical.Operation]framework.OperationHandler{
@@ -61,141 +73,263 @@ func pathEncrypt(b *backend) []*framework.Path {
 func (b *backend) encrypt(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	b.Logger().Info("Invoked: Encryption")
 
-	message := data.Get("message").(string)
-	policy_str := data.Get("policy").(string)
+	// Every item of a batch is encrypted with the attribute keys read once for the whole request
+	attributesList, err := b.allAttributesPutTogether(ctx, req)
+	if err != nil {
+		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+	}
 
-	if len(message) == 0 {
-		return logical.ErrorResponse("Empty message for encryption"), nil
+	config, err := b.getPerformanceConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
 	}
 
-	ecElement := b.getABEElement()
+	request := map[string]string{
+		"message":   data.Get("message").(string),
+		"plaintext": data.Get("plaintext").(string),
+		"policy":    data.Get("policy").(string),
+		"cipher":    data.Get("cipher").(string),
+		"format":    data.Get("format").(string),
+	}
 
-	s := ecElement.Pairing().NewZr().Rand()
-	w := ecElement.Pairing().NewZr()
+	rawBatchInput, hasBatchInput := data.GetOk("batch_input")
+	if !hasBatchInput {
+		itemData, resp, err := b.encryptItem(ctx, request, attributesList, config.Workers)
+		if err != nil || resp != nil {
+			return resp, err
+		}
 
-	randomnessGenerator := ecElement.Pairing().NewGT().Rand() // A random element `randomnessGenerator` in GT is created - It will be used to correlate a key with the EC
-	randomKey := sha256.Sum256([]byte(randomnessGenerator.String()))
+		return &logical.Response{
+			Data: itemData,
+		}, nil
+	}
 
-	cipher, err := aes.NewCipher(randomKey[:])
+	batchInput, err := parseBatchInput(rawBatchInput)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	batchResults := make([]map[string]interface{}, 0, len(batchInput))
 
+	for _, item := range batchInput {
+		// The data to encrypt always comes from the item itself
+		for _, field := range []string{"policy", "cipher", "format"} {
+			item[field] = batchItemValue(item, field, request[field])
+		}
+
+		itemData, resp, err := b.encryptItem(ctx, item, attributesList, config.Workers)
+		batchResults = append(batchResults, batchItemResult(itemData, resp, err))
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"batch_results": batchResults,
+		},
+	}, nil
+}
+
+// encryptItem encrypts a single message, returning the response data or a response explaining why it could not be encrypted
+func (b *backend) encryptItem(ctx context.Context, item map[string]string, attributesList map[string]keysData, workers int) (map[string]interface{}, *logical.Response, error) {
+	message := item["message"]
+	b64Plaintext := item["plaintext"]
+	policy_str := item["policy"]
+	cipherType := strings.ToLower(item["cipher"])
+	format := strings.ToLower(item["format"])
+
+	if len(message) > 0 && len(b64Plaintext) > 0 {
+		return nil, logical.ErrorResponse("Provide either a message or a plaintext, not both"), nil
+	}
+
+	plaintext := []byte(message)
+	if len(b64Plaintext) > 0 {
+		decodedPlaintext, err := b64.StdEncoding.DecodeString(b64Plaintext)
+		if err != nil {
+			return nil, logical.ErrorResponse("The plaintext must be base64 encoded"), nil
+		}
+		plaintext = decodedPlaintext
+	}
+
+	if len(plaintext) == 0 {
+		return nil, logical.ErrorResponse("Empty message for encryption"), nil
+	}
+
+	if !isSupportedCipher(cipherType) {
+		return nil, logical.ErrorResponse(fmt.Sprintf("Unsupported cipher %s (supported: %s, %s)", cipherType, cipherAES256GCM, cipherChaCha20Poly1305)), nil
+	}
+
+	if format != cryptogramFormatJSON && format != cryptogramFormatBinary {
+		return nil, logical.ErrorResponse(fmt.Sprintf("Unsupported format %s (supported: %s, %s)", format, cryptogramFormatJSON, cryptogramFormatBinary)), nil
+	}
+
+	policy, err := createPolicy(policy_str)
 	if err != nil {
-		return nil, errwrap.Wrapf("error in encryption: {{err}}", err)
+		return nil, logical.ErrorResponse(fmt.Sprintf("Invalid policy: %s", err)), nil
 	}
 
-	iv := make([]byte, cipher.BlockSize())
-	_, err = io.ReadFull(rand.Reader, iv)
+	generatedData, randomKey, resp, err := b.encapsulate(ctx, policy, policy_str, cipherType, attributesList, workers)
+	if err != nil || resp != nil {
+		return nil, resp, err
+	}
+	generatedData.format = format
+
+	// The policy and the ABE components are authenticated together with the message
+	generatedData.EncryptedMessage, generatedData.CipherIV, err = sealPayload(cipherType, randomKey, plaintext, generatedData.associatedData())
 	if err != nil {
-		return nil, errwrap.Wrapf("error in encryption: {{err}}", err)
+		return nil, nil, errwrap.Wrapf("error in encryption: {{err}}", err)
 	}
 
-	secretMessageAsBytes := []byte(message) // The message (string) as a byte's slice
-	paddingLength := cipher.BlockSize() - (len(secretMessageAsBytes) % cipher.BlockSize())
-	secretMsgPadded := make([]byte, len(secretMessageAsBytes)+paddingLength)
-	copy(secretMsgPadded, secretMessageAsBytes)
-	for i := len(secretMessageAsBytes); i < len(secretMsgPadded); i++ {
-		secretMsgPadded[i] = byte(paddingLength)
+	b64Encoded, err := b.encodeCryptogram(*generatedData)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	encrypter := cbc.NewCBCEncrypter(cipher, iv)
-	symmetricEncryptedMessage := make([]byte, len(secretMsgPadded))
-	encrypter.CryptBlocks(symmetricEncryptedMessage, secretMsgPadded)
+	return map[string]interface{}{
+		"b64_enc_data": b64Encoded,
+	}, nil, nil
+}
+
+// encapsulate samples the GT session element and builds C0, C1, C2 and C3 for the policy.
+// It returns the cryptogram (without any payload) and the symmetric key derived from the session element,
+// or a response listing the availability of the attributes if some of them are unknown.
+func (b *backend) encapsulate(ctx context.Context, policy node, policy_str string, cipherType string, attributesList map[string]keysData, workers int) (*cryptogram, []byte, *logical.Response, error) {
+	ecElement := b.getABEElement()
+
+	s := ecElement.Pairing().NewZr().Rand()
+	w := ecElement.Pairing().NewZr()
+
+	header, err := b.newCryptogramHeader(cipherType, policy.uniqueAttributes(), attributesList)
+	if err != nil {
+		return nil, nil, nil, errwrap.Wrapf("error in encryption: {{err}}", err)
+	}
+
+	randomnessGenerator := ecElement.Pairing().NewGT().Rand() // A random element `randomnessGenerator` in GT is created - It will be used to correlate a key with the EC
+	randomKey, err := deriveSymmetricKey(header.KDF, randomnessGenerator, header.KDFSalt)
+	if err != nil {
+		return nil, nil, nil, errwrap.Wrapf("error in encryption: {{err}}", err)
+	}
 
-	egg_s := ecElement.Pairing().NewGT()
-	egg_s.Pair(ecElement, ecElement).ThenPowZn(s)
+	generatorTables := b.getGeneratorTables()
+
+	egg_s := ecElement.Pairing().NewGT().PowerZn(generatorTables.eggPower, s)
 
 	messageMap := ecElement.Pairing().NewGT().Set(egg_s).ThenMul(randomnessGenerator).Bytes()
 
-	policy := createPolicy(policy_str)
 	sshares, wshares := make(map[string]*pbc.Element), make(map[string]*pbc.Element)
 	policy.calculateSharesList(ecElement, s, sshares)
 	policy.calculateSharesList(ecElement, w, wshares)
 
 	C1El, C2El, C3El := make(map[string][]byte), make(map[string][]byte), make(map[string][]byte)
 
-	attributesList, err := b.allAttributesPutTogether(ctx, req)
-
-	if err != nil {
-		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+	if resp, err := b.checkEncryptionPolicy(ctx, policy, attributesList); err != nil || resp != nil {
+		return nil, nil, resp, err
 	}
 
-	unavailableAttrs, CheckedAttrs := b.checkAttributesAvailability(sshares, attributesList)
+	// The attributes are processed in a fixed order and their randomness is drawn before the fan-out,
+	// so that the workers only compute with it
+	attributes := make([]string, 0, len(sshares))
+	for attr := range sshares {
+		attributes = append(attributes, attr)
+	}
+	sort.Strings(attributes)
 
-	if unavailableAttrs {
-		return &logical.Response{
-			Data: map[string]interface{}{
-				"attributes_availability": CheckedAttrs,
-			},
-		}, nil
+	r_xs := make([]*pbc.Element, len(attributes))
+	for i := range attributes {
+		r_xs[i] = ecElement.Pairing().NewZr().Rand()
 	}
 
-	for attr := range sshares {
+	C1List, C2List, C3List := make([][]byte, len(attributes)), make([][]byte, len(attributes)), make([][]byte, len(attributes))
+
+	err = forEachParallel(len(attributes), workers, func(i int) error {
+		attr := attributes[i]
 		attribute := strings.ToUpper(attr)
 
-		eggAlphaI := ecElement.Pairing().NewGT().SetBytes(attributesList[attribute].Alphai)
-		gYI := ecElement.Pairing().NewG1().SetBytes(attributesList[attribute].Yi)
+		attributeTables := b.getAttributeTables(attribute, attributesList[attribute])
 
-		w_share := fmt.Sprint(wshares[attr])
-		s_share := fmt.Sprint(sshares[attr])
-		s_shareBig := new(big.Int)
-		w_shareBig := new(big.Int)
-		s_shareBig, err_sshare := s_shareBig.SetString(s_share, 10)
-		w_shareBig, err_wshare := w_shareBig.SetString(w_share, 10)
-		_, _ = err_sshare, err_wshare
+		s_shareBig, s_shareIsOk := new(big.Int).SetString(sshares[attr].String(), 10)
+		w_shareBig, w_shareIsOk := new(big.Int).SetString(wshares[attr].String(), 10)
+		if !s_shareIsOk || !w_shareIsOk {
+			return fmt.Errorf("invalid share for attribute %s", attr)
+		}
 
-		r_x := ecElement.Pairing().NewZr().Rand()
+		r_x := r_xs[i]
 
 		fieldC1Base := ecElement.Pairing().NewGT()
 
-		fieldC1V1 := ecElement.Pairing().NewGT()
-		fieldC1V1v1 := ecElement.Pairing().NewGT().Pair(ecElement, ecElement)
-		fieldC1V1.Set(fieldC1V1v1).ThenPowBig(s_shareBig)
+		fieldC1V1 := ecElement.Pairing().NewGT().PowerBig(generatorTables.eggPower, s_shareBig)
 
-		fieldC1V2 := ecElement.Pairing().NewGT()
-		fieldC1V2.Set(eggAlphaI)
-		fieldC1V2.ThenPowZn(r_x)
+		fieldC1V2 := ecElement.Pairing().NewGT().PowerZn(attributeTables.eggAlphaPower, r_x)
 
 		fieldC1Base.Mul(fieldC1V1, fieldC1V2)
 
-		C1El[attr] = fieldC1Base.Bytes()
+		C1List[i] = fieldC1Base.Bytes()
 
-		fieldC2Base := ecElement.Pairing().NewG1()
-		fieldC2Base.Set(ecElement).ThenPowZn(r_x)
+		fieldC2Base := ecElement.Pairing().NewG2().PowerZn(generatorTables.hPower, r_x)
 
-		C2El[attr] = fieldC2Base.Bytes()
+		C2List[i] = fieldC2Base.Bytes()
 
-		fieldC3Base := ecElement.Pairing().NewG1()
+		fieldC3Base := ecElement.Pairing().NewG2()
 
-		fieldC3V1 := ecElement.Pairing().NewG1()
-		fieldC3V1.Set(gYI).ThenPowZn(r_x)
+		fieldC3V1 := ecElement.Pairing().NewG2().PowerZn(attributeTables.gYPower, r_x)
 
-		fieldC3V2 := ecElement.Pairing().NewG1()
-		fieldC3V2.Set(ecElement).ThenPowBig(w_shareBig)
+		fieldC3V2 := ecElement.Pairing().NewG2().PowerBig(generatorTables.hPower, w_shareBig)
 
 		fieldC3Base.Set(fieldC3V1).ThenMul(fieldC3V2)
 
-		C3El[attr] = fieldC3Base.Bytes()
+		C3List[i] = fieldC3Base.Bytes()
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, errwrap.Wrapf("error in encryption: {{err}}", err)
 	}
 
-	generatedData := cryptogram{
-		C0:               messageMap,
-		C1:               C1El,
-		C2:               C2El,
-		C3:               C3El,
-		EncryptedMessage: symmetricEncryptedMessage,
-		CipherIV:         iv,
-		PolicyStr:        policy_str,
+	for i, attr := range attributes {
+		C1El[attr], C2El[attr], C3El[attr] = C1List[i], C2List[i], C3List[i]
 	}
 
-	exported, err := json.Marshal(generatedData)
-	if err != nil {
-		return nil, err
+	return &cryptogram{
+		Header:    header,
+		C0:        messageMap,
+		C1:        C1El,
+		C2:        C2El,
+		C3:        C3El,
+		PolicyStr: policy_str,
+	}, randomKey, nil, nil
+}
+
+// checkEncryptionPolicy makes the checks of encrypt on a policy, returning a response explaining why nothing can be encrypted
+// under it: every attribute must be known (a duplicate attribute is labelled, e.g. `A_0`, and is never known) and the latest
+// version of its keys must not be below its min_encryption_version
+func (b *backend) checkEncryptionPolicy(ctx context.Context, policy node, attributesList map[string]keysData) (*logical.Response, error) {
+	attributes := policy.getAttributeList()
+	sort.Strings(attributes)
+
+	labels := make(map[string]*pbc.Element, len(attributes))
+	for _, attr := range attributes {
+		labels[attr] = nil
 	}
 
-	b64Encoded := b64.StdEncoding.EncodeToString([]byte(exported))
+	unavailableAttrs, CheckedAttrs := b.checkAttributesAvailability(labels, attributesList)
 
-	return &logical.Response{
-		Data: map[string]interface{}{
-			"b64_enc_data": b64Encoded,
-		},
-	}, nil
+	if unavailableAttrs {
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"attributes_availability": CheckedAttrs,
+			},
+		}, nil
+	}
+
+	for _, attr := range attributes {
+		config, err := b.getKeyConfig(ctx, attr)
+		if err != nil {
+			return nil, err
+		}
+
+		// The index of a standby may not have caught up with a rotation yet
+		if keyVersion := attributesList[strings.ToUpper(attr)].keyVersion(); keyVersion < config.MinEncryptionVersion {
+			return logical.ErrorResponse(fmt.Sprintf("The version %d of the keys of %s is below its min_encryption_version %d", keyVersion, attr, config.MinEncryptionVersion)), nil
+		}
+	}
+
+	return nil, nil
 }
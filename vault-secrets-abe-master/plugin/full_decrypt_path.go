@@ -2,13 +2,11 @@ package abe
 
 import (
 	"context"
-	"crypto/aes"
-	cbc "crypto/cipher"
-	"crypto/sha256"
 	b64 "encoding/base64"
-	"encoding/json"
+	"fmt"
 	"math/big"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/Nik-U/pbc"
 	"github.com/go-errors/errors"
@@ -30,12 +28,15 @@ func pathFullDecrypt(b *backend) []*framework.Path {
 				"cryptogram": {
 					Type:        framework.TypeString,
 					Description: "The cryptogram",
-					Required:    true,
 				},
 				"sub_policy": {
 					Type:        framework.TypeString,
 					Description: "[Required] The policy to use for system decryption",
 				},
+				"batch_input": {
+					Type:        framework.TypeSlice,
+					Description: batchInputDescription,
+				},
 			},
 
 			Operations: map[logical.Operation]framework.OperationHandler{
@@ -66,32 +67,112 @@ func (b *backend) fullDecrypt(ctx context.Context, req *logical.Request, data *f
 	GID := data.Get("entity_id").(string)
 	sub_policy_str := data.Get("sub_policy").(string)
 
-	sub_policy := createPolicy(sub_policy_str)
+	config, err := b.getPerformanceConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
 
-	encryptedMessage := data.Get("cryptogram").(string)
+	// The keys of the GID are read once, for every cryptogram of the request
+	GIDData, err := b.loadGIDData(ctx, req, GID)
+	if err != nil {
+		return nil, errwrap.Wrapf("Error with GID data: {{err}}", err)
+	}
 
-	b64DecodedEncMsg, b64EncMsgErr := b64.StdEncoding.DecodeString(encryptedMessage)
-	if b64EncMsgErr != nil {
-		return nil, errwrap.Wrapf("read failed: {{err}}", b64EncMsgErr)
+	rawBatchInput, hasBatchInput := data.GetOk("batch_input")
+	if !hasBatchInput {
+		itemData, resp, err := b.fullDecryptItem(ctx, GID, GIDData, sub_policy_str, data.Get("cryptogram").(string), config.Workers)
+		if err != nil || resp != nil {
+			return resp, err
+		}
+
+		return &logical.Response{
+			Data: itemData,
+		}, nil
 	}
-	var cts cryptogram
-	err := json.Unmarshal(b64DecodedEncMsg, &cts)
+
+	batchInput, err := parseBatchInput(rawBatchInput)
 	if err != nil {
-		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	batchResults := make([]map[string]interface{}, 0, len(batchInput))
+
+	for _, item := range batchInput {
+		itemData, resp, err := b.fullDecryptItem(ctx, GID, GIDData, batchItemValue(item, "sub_policy", sub_policy_str), item["cryptogram"], config.Workers)
+		batchResults = append(batchResults, batchItemResult(itemData, resp, err))
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"batch_results": batchResults,
+		},
+	}, nil
+}
+
+// fullDecryptItem decrypts a single cryptogram, returning the response data or a response explaining why it could not be decrypted
+func (b *backend) fullDecryptItem(ctx context.Context, GID string, GIDData gidData, sub_policy_str string, encryptedMessage string, workers int) (map[string]interface{}, *logical.Response, error) {
+	sub_policy, err := createPolicy(sub_policy_str)
+	if err != nil {
+		return nil, logical.ErrorResponse(fmt.Sprintf("Invalid sub_policy: %s", err)), nil
+	}
+
+	cts, err := b.decodeCryptogram(encryptedMessage)
+	if err != nil {
+		return nil, logical.ErrorResponse(fmt.Sprintf("Invalid cryptogram: %s", err)), nil
+	}
+
+	if cts.cipherType() == cipherNone {
+		return nil, logical.ErrorResponse("The cryptogram only wraps a data key, use datakey/decrypt to recover it"), nil
+	}
+
+	policy, err := createPolicy(cts.PolicyStr)
+	if err != nil {
+		return nil, logical.ErrorResponse(fmt.Sprintf("Invalid cryptogram policy: %s", err)), nil
+	}
+
+	randomKey, resp, err := b.decapsulate(ctx, GID, GIDData, sub_policy, policy, &cts, workers)
+	if err != nil || resp != nil {
+		return nil, resp, err
+	}
+
+	msgBytes, err := openPayload(cts.cipherType(), randomKey, cts.CipherIV, cts.EncryptedMessage, cts.associatedData())
+	if err != nil {
+		return nil, logical.ErrorResponse(fmt.Sprintf("Decryption error: %s", err)), nil
+	}
+
+	itemData := map[string]interface{}{
+		"plaintext": b64.StdEncoding.EncodeToString(msgBytes),
 	}
 
+	// Textual payloads are also returned as they are, as before the `plaintext` field existed
+	if utf8.Valid(msgBytes) {
+		itemData["decrypted_data"] = string(msgBytes)
+	}
+
+	return itemData, nil, nil
+}
+
+// decapsulate recovers the GT session element of the cryptogram with the keys of the GID
+// and returns the symmetric key derived from it, or an error response if the keys do not satisfy the policy.
+func (b *backend) decapsulate(ctx context.Context, GID string, GIDData gidData, sub_policy node, policy node, cts *cryptogram, workers int) ([]byte, *logical.Response, error) {
 	ecElement := b.getABEElement()
 
 	policyAttrs := sub_policy.getAttributeList()
-	GIDData, _ := b.loadGIDData(ctx, req, GID)
 	// Merge all the available attributes, together
 	mergedAttrs := make(map[string][]byte)
 	mergedAttrsList := []string{} // We need to construct and populate this list in order to check if our attributes define the given policy
 
+	// Only the keys of the versions the cryptogram was encrypted with are of use
 	for _, attribute := range policyAttrs {
 		if GIDData.COMMON_ATTRIBUTES[attribute] != nil {
-			mergedAttrs[attribute] = GIDData.COMMON_ATTRIBUTES[attribute]
-			mergedAttrsList = append(mergedAttrsList, attribute)
+			key, err := b.cryptogramKey(ctx, GIDData, attribute, GIDData.COMMON_ATTRIBUTES[attribute], cts)
+			if err != nil {
+				return nil, nil, err
+			}
+			if key != nil {
+				mergedAttrs[attribute] = key
+				mergedAttrsList = append(mergedAttrsList, attribute)
+			}
 			continue
 		}
 
@@ -101,27 +182,44 @@ func (b *backend) fullDecrypt(ctx context.Context, req *logical.Request, data *f
 			// e.g. Attribute[Authority0] => Authority0, Attribute
 			authorityAttribute, trimmedAttribute, err := b.separateAuthorityFromAttribute(attribute)
 
-			if (err != nil) {
-				return nil, errwrap.Wrapf("Internal error: {{err}}", err)
+			if err != nil {
+				return nil, nil, errwrap.Wrapf("Internal error: {{err}}", err)
 			}
 
-			if (authority == authorityAttribute) {
+			if authority == authorityAttribute {
 				if authAttributes[trimmedAttribute] != nil {
-					mergedAttrs[attribute] = authAttributes[trimmedAttribute]
-					mergedAttrsList = append(mergedAttrsList, attribute)
+					key, err := b.cryptogramKey(ctx, GIDData, attribute, authAttributes[trimmedAttribute], cts)
+					if err != nil {
+						return nil, nil, err
+					}
+					if key != nil {
+						mergedAttrs[attribute] = key
+						mergedAttrsList = append(mergedAttrsList, attribute)
+					}
 					break
 				}
 			}
 		}
 	}
 
-	policy := createPolicy(cts.PolicyStr)
+	// The system attributes `sysdecrypt` computed take part in the decryption as well
+	for attribute := range cts.SysDecryptedAttr {
+		if mergedAttrs[attribute] == nil {
+			mergedAttrsList = append(mergedAttrsList, attribute)
+		}
+	}
+
+	// The attributes are pruned once, on the policy of the cryptogram, so that the threshold gates are reconstructed
+	// from the same children whether their attributes are system or user ones
 	coeff_list := make(map[string]*pbc.Element)
-	policy.getCoefficients(ecElement, coeff_list)
-	policySatisfied, pruned := sub_policy.prune(mergedAttrsList)
+	policySatisfied, pruned := policy.prune(mergedAttrsList)
 
 	if !policySatisfied {
-		return logical.ErrorResponse(`The given Policy does not satisfy the available attributes`), nil
+		return nil, logical.ErrorResponse(`The given Policy does not satisfy the available attributes`), nil
+	}
+
+	if err := policy.getCoefficients(ecElement, coeff_list, pruned); err != nil {
+		return nil, nil, errwrap.Wrapf("error with attribute's coefficient: {{err}}", err)
 	}
 
 	EggS := ecElement.Pairing().NewGT()
@@ -129,33 +227,60 @@ func (b *backend) fullDecrypt(ctx context.Context, req *logical.Request, data *f
 	gidMapper := b.createHashMapper(ecElement)
 	hashedGIDInEC := gidMapper(GID)
 
-	for _, attribute := range pruned {
-		attributeCoeff, attributeCoeffIsOk := new(big.Int).SetString(coeff_list[attribute].String(), 10) // If an attribute is not known, returns an error (policySatisfied should be used instead) - Should investigate
+	attributeCoeffs := make([]*big.Int, len(pruned))
+	for i, attribute := range pruned {
+		if coeff_list[attribute] == nil {
+			return nil, nil, fmt.Errorf("the attribute %s has no coefficient", attribute)
+		}
+		attributeCoeff, attributeCoeffIsOk := new(big.Int).SetString(coeff_list[attribute].String(), 10)
 		if !attributeCoeffIsOk {
-			return nil, errwrap.Wrapf("error with attribute's coefficient", errors.New("Coefficient error"))
+			return nil, nil, errwrap.Wrapf("error with attribute's coefficient", errors.New("Coefficient error"))
 		}
+		attributeCoeffs[i] = attributeCoeff
+	}
+
+	// The pairings of every attribute are computed in parallel and multiplied together in the order of `pruned`
+	divs := make([]*pbc.Element, len(pruned))
 
-		C1Element := ecElement.Pairing().NewGT().SetBytes(cts.C1[attribute])
-		C2Element := ecElement.Pairing().NewG1().SetBytes(cts.C2[attribute])
-		C3Element := ecElement.Pairing().NewG1().SetBytes(cts.C3[attribute])
+	err := forEachParallel(len(pruned), workers, func(i int) error {
+		attribute := pruned[i]
 
-		SKElement := ecElement.Pairing().NewG1().SetBytes(mergedAttrs[attribute])
+		div := ecElement.Pairing().NewGT()
 
-		fieldNumBase := ecElement.Pairing().NewGT()
-		fieldNumEl := ecElement.Pairing().NewGT()
-		fieldNumEl.Pair(hashedGIDInEC, C3Element)
-		fieldNumBase.Set(C1Element).ThenMul(fieldNumEl)
+		if mergedAttrs[attribute] == nil {
+			div.SetBytes(cts.SysDecryptedAttr[attribute])
+		} else {
+			C1Element := ecElement.Pairing().NewGT().SetBytes(cts.C1[attribute])
+			C2Element := ecElement.Pairing().NewG2().SetBytes(cts.C2[attribute])
+			C3Element := ecElement.Pairing().NewG2().SetBytes(cts.C3[attribute])
 
-		fieldDemBase := ecElement.Pairing().NewGT()
-		fieldDemBase.Pair(SKElement, C2Element)
+			SKElement := ecElement.Pairing().NewG1().SetBytes(mergedAttrs[attribute])
 
-		div := ecElement.Pairing().NewGT()
-		div.Set(fieldNumBase).ThenDiv(fieldDemBase)
-		div.PowBig(div, attributeCoeff)
+			fieldNumBase := ecElement.Pairing().NewGT()
+			fieldNumEl := ecElement.Pairing().NewGT()
+			fieldNumEl.Pair(hashedGIDInEC, C3Element)
+			fieldNumBase.Set(C1Element).ThenMul(fieldNumEl)
 
+			fieldDemBase := ecElement.Pairing().NewGT()
+			fieldDemBase.Pair(SKElement, C2Element)
+
+			div.Set(fieldNumBase).ThenDiv(fieldDemBase)
+		}
+		div.PowBig(div, attributeCoeffs[i])
+
+		divs[i] = div
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, errwrap.Wrapf("error in decryption: {{err}}", err)
+	}
+
+	for _, div := range divs {
 		EggS.Mul(EggS, div)
 	}
 
+	// Cryptograms partially decrypted before the parts of the system attributes were kept apart
 	if len(cts.SysDecrypted) > 0 {
 		sys_decrypted := ecElement.Pairing().NewGT().SetBytes(cts.SysDecrypted)
 		EggS.ThenMul(sys_decrypted)
@@ -166,28 +291,10 @@ func (b *backend) fullDecrypt(ctx context.Context, req *logical.Request, data *f
 
 	// The `decrypted` element is the EC element that is related with our secret key
 	// We will recreate the secret key
-	randomKey := sha256.Sum256([]byte(decrypted.String()))
-	cipher, err := aes.NewCipher(randomKey[:])
-
+	randomKey, err := cts.symmetricKey(decrypted)
 	if err != nil {
-		return logical.ErrorResponse(`Decryption error (Error Code: 1)`), nil
+		return nil, logical.ErrorResponse(fmt.Sprintf("Decryption error: %s", err)), nil
 	}
 
-	secretMsgPadded := make([]byte, len(cts.EncryptedMessage))
-	decrypter := cbc.NewCBCDecrypter(cipher, cts.CipherIV)
-	decrypter.CryptBlocks(secretMsgPadded, cts.EncryptedMessage)
-
-	paddingLength := int(secretMsgPadded[len(secretMsgPadded)-1])
-
-	if (len(secretMsgPadded) - paddingLength) < 0 {
-		return logical.ErrorResponse(`Decryption error (Error Code: 2)`), nil
-	}
-
-	msgBytes := secretMsgPadded[0:(len(secretMsgPadded) - paddingLength)]
-
-	return &logical.Response{
-		Data: map[string]interface{}{
-			"decrypted_data": string(msgBytes),
-		},
-	}, nil
+	return randomKey, nil, nil
 }
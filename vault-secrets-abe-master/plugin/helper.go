@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/Nik-U/pbc"
@@ -32,32 +33,58 @@ func (b *backend) createHashMapper(ecElement *pbc.Element) func(GID string) *pbc
 	return mapper
 }
 
-func (b *backend) loadEC(ctx context.Context) (*pbc.Element, error) {
+// loadEC loads and validates the global parameters, returning the generators of G1 and G2 and the PBC parameters
+func (b *backend) loadEC(ctx context.Context) (*pbc.Element, *pbc.Element, []byte, error) {
 
 	out, err := b.storage.Get(ctx, coreABEGroupKeyPath)
 
 	if err != nil {
-		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+		return nil, nil, nil, errwrap.Wrapf("read failed: {{err}}", err)
 	}
 
 	if out == nil {
-		return nil, nil
+		return nil, nil, nil, nil
 	}
 
 	var ecData encodedG
 	if err := jsonutil.DecodeJSON(out.Value, &ecData); err != nil {
-		return nil, errwrap.Wrapf("json decoding failed: {{err}}", err)
+		return nil, nil, nil, errwrap.Wrapf("json decoding failed: {{err}}", err)
 	}
 
 	ecParams := string([]byte(ecData.Params))
 
-	loadedParams, _ := pbc.NewParamsFromString(ecParams)
+	loadedParams, err := pbc.NewParamsFromString(ecParams)
+	if err != nil {
+		return nil, nil, nil, errwrap.Wrapf("invalid pairing parameters: {{err}}", err)
+	}
 
 	pairing := loadedParams.NewPairing()
+	if err := checkParamSet(ecData.ParamSet, pairing); err != nil {
+		return nil, nil, nil, err
+	}
 
 	element := pairing.NewG1().SetCompressedBytes(ecData.EncodedG)
+	if element.Is1() {
+		return nil, nil, nil, errors.New("invalid generator of G1")
+	}
 
-	return element, nil
+	if pairing.IsSymmetric() {
+		if len(ecData.EncodedH) > 0 {
+			return nil, nil, nil, errors.New("symmetric pairings have no separate generator of G2")
+		}
+		return element, element, ecData.Params, nil
+	}
+
+	if len(ecData.EncodedH) == 0 {
+		return nil, nil, nil, errors.New("the generator of G2 is missing")
+	}
+
+	g2Element := pairing.NewG2().SetBytes(ecData.EncodedH)
+	if g2Element.Is1() {
+		return nil, nil, nil, errors.New("invalid generator of G2")
+	}
+
+	return element, g2Element, ecData.Params, nil
 }
 
 func (b *backend) getKeyData(ctx context.Context, req *logical.Request, attribute string, authority string, isCommon bool, isSystemAttribute bool, needPrivateKeys bool) (*pbc.Element, *pbc.Element, error) {
@@ -187,8 +214,6 @@ func (b *backend) dataStore(ctx context.Context, data interface{}, pathOptions .
 	if prePathType == genpath {
 		GID := data.(gidData).GID
 		storageLocation = prePathType + keypathGids + GID
-	} else if prePathType == majorityConcernsDir {
-		storageLocation = prePathType
 	} else {
 		storageLocation = prePathType + pathOptions[1] + pathOptions[2]
 	}
@@ -249,6 +274,13 @@ func (b *backend) dataKeyStore(ctx context.Context, publishedData interface{}, p
 	return nil
 }
 
+// getABEG2Element returns the generator of G2, which is the generator of G1 for symmetric pairings
+func (b *backend) getABEG2Element() *pbc.Element {
+	element, _ := b.abeCache.Get(abeG2Cache)
+
+	return element.(*pbc.Element)
+}
+
 func (b *backend) getABEElement() *pbc.Element {
 
 	element, exists := b.abeCache.Get(abecache)
@@ -469,7 +501,8 @@ func (b *backend) attributeNotASystemAttribute(ctx context.Context, authorityAtt
 	}
 }
 
-func (b *backend) allAttributesPutTogether(ctx context.Context, req *logical.Request) (map[string]keysData, error) {
+// scanAttributeKeys reads the published keys of every attribute from the storage (see attributeIndex)
+func (b *backend) scanAttributeKeys(ctx context.Context) (map[string]keysData, error) {
 	entries, err := b.getEntries(ctx, []string{AuthoritiesPath})
 	if err != nil {
 		return nil, errwrap.Wrapf("read failed: {{err}}", err)
@@ -490,21 +523,37 @@ func (b *backend) allAttributesPutTogether(ctx context.Context, req *logical.Req
 
 			var newData keysData
 
-			out, err := req.Storage.Get(ctx, AuthoritiesPath+entryAsDir+attributeEntryAsDir+privateAccessor)
+			out, err := b.storage.Get(ctx, AuthoritiesPath+entryAsDir+attributeEntryAsDir+privateAccessor)
 
-			if err != nil || out == nil {
+			if err != nil {
 				return nil, errwrap.Wrapf("read failed: {{err}}", err)
 			}
 
+			// Keys that are still being written
+			if out == nil {
+				continue
+			}
+
+			// Retired system attributes keep their keys for decryption only
+			if entry == SystemAttributes {
+				info, err := b.loadSystemAttributeInfo(ctx, attributeEntry)
+				if err != nil {
+					return nil, err
+				}
+				if info != nil && info.Retired {
+					continue
+				}
+			}
+
 			if err := jsonutil.DecodeJSON(out.Value, &newData); err != nil {
 				return nil, errwrap.Wrapf("json decoding failed: {{err}}", err)
 			}
 
-			if (entry != SystemAttributes && entry != CommonAttributes) {
+			if entry != SystemAttributes && entry != CommonAttributes {
 				attributeEntry = attributeEntry + "[" + strings.ToUpper(entry) + "]"
 			}
 
-			data[attributeEntry] = newData 
+			data[attributeEntry] = newData
 		}
 	}
 
@@ -584,4 +633,26 @@ func sliceContains(s []string, str string) bool {
 		}
 	}
 	return false
-}
\ No newline at end of file
+}
+
+// gidAttributeList returns the names of every attribute a GID holds keys for, in the form they take in a policy
+// (ATTRIBUTE for common and system attributes, ATTRIBUTE[AUTHORITY] for authority attributes)
+func (b *backend) gidAttributeList(GIDData gidData) []string {
+	attributes := []string{}
+
+	for attribute := range GIDData.COMMON_ATTRIBUTES {
+		attributes = append(attributes, attribute)
+	}
+
+	for authority, authAttributes := range GIDData.AUTHORITY_ATTRIBUTES {
+		for attribute := range authAttributes {
+			attributes = append(attributes, attribute+"["+strings.ToUpper(authority)+"]")
+		}
+	}
+
+	attributes = append(attributes, GIDData.SYSTEM_ATTRIBUTES...)
+
+	sort.Strings(attributes)
+
+	return attributes
+}
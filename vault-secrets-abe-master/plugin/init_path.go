@@ -2,92 +2,383 @@ package abe
 
 import (
 	"context"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
 
 	"github.com/Nik-U/pbc"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
-func (b *backend) abeGlobalSetup() (*pbc.Element, []byte) {
-	//params := pbc.GenerateA(160, 512)
-	params, _ := pbc.NewParamsFromString(`type a
-	q 8780710799663312522437781984754049815806883199414208211028653399266475630880222957078625179422662221423155858769582317459277713367317481324925129998224791
-	h 12016012264891146079388821366740534204802954401251311822919615131047207289359704531102844802183906537786776
-	r 730750818665451621361119245571504901405976559617
-	exp2 159
-	exp1 107
-	sign1 1
-	sign0 1`)
+const initPath = "config/init"
+
+// plainNameRegex matches the names of authorities and of attributes without an authority
+var plainNameRegex = regexp.MustCompile(`^[\w\-.]+$`)
+
+// abeGlobalSetup generates the global parameters of the mount for a parameter set (see generateParams)
+func (b *backend) abeGlobalSetup(paramSet string, customParams string) (*encodedG, *pbc.Element, *pbc.Element, error) {
+	params, err := generateParams(paramSet, customParams)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
 	savedParams := []byte(params.String())
 	pairing := params.NewPairing()
-	globalECElement := pairing.NewG1().Rand()
-	return globalECElement, savedParams
-}
+	if err := checkParamSet(paramSet, pairing); err != nil {
+		return nil, nil, nil, err
+	}
 
-func (b *backend) initializeABE(ctx context.Context, req *logical.InitializationRequest) error {
+	globalECElement, globalG2Element := generateGenerators(pairing)
 
-	entry, err := b.storage.Get(ctx, coreABEGroupKeyPath)
+	encoded := &encodedG{
+		EncodedG: globalECElement.CompressedBytes(),
+		Params:   savedParams,
+		ParamSet: paramSet,
+	}
+
+	if !pairing.IsSymmetric() {
+		encoded.EncodedH = globalG2Element.Bytes()
+	}
 
+	return encoded, globalECElement, globalG2Element, nil
+}
+
+// initializeABE loads the global parameters of an initialized mount; new mounts wait for a write to config/init
+func (b *backend) initializeABE(ctx context.Context, req *logical.InitializationRequest) error {
 	b.Logger().Info("Starting initialization for the ABE Plugin")
 
+	ecElement, g2Element, params, err := b.loadEC(ctx)
 	if err != nil {
-		b.Logger().Error("error running initialization", "error", err)
+		b.Logger().Error("error loading the global parameters", "error", err)
 		return err
 	}
 
-	if entry == nil {
+	if ecElement == nil {
+		b.Logger().Info("The ABE Plugin is not initialized yet, waiting for a write to " + initPath)
+		return nil
+	}
+
+	b.cacheEC(ecElement, g2Element, params)
+
+	// A failure is not fatal: the index is loaded again on first use
+	if _, err := b.loadAttributeIndex(ctx); err != nil {
+		b.Logger().Error("error loading the attribute index", "error", err)
+	}
+
+	return nil
+}
+
+func pathInit(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: initPath,
+
+			Fields: map[string]*framework.FieldSchema{
+				"param_set": {
+					Type:        framework.TypeString,
+					Description: fmt.Sprintf("The pairing parameter set (%s); defaults to the parameters chosen at %s, or %s", strings.Join(supportedParamSets, ", "), paramsConfigPath, defaultParamSet),
+				},
+				"params": {
+					Type:        framework.TypeString,
+					Description: "The PBC parameters, in the format of the PBC library (only for the `custom` parameter set)",
+				},
+				"system_attributes": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "The initial system attributes",
+					Default:     []string{"SA"},
+				},
+				"authorities": {
+					Type:        framework.TypeMap,
+					Description: "The initial authorities, mapped to the list of their attributes (e.g. `{\"HOSPITAL\": [\"DOCTOR\", \"NURSE\"]}`)",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.readInitStatus,
+					Summary:  "Report whether the mount is initialized.",
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback:    b.initialize,
+					Summary:     "Initialize the mount.",
+					Description: "Generates the global parameters, the keys of the initial system attributes and the keys of the initial authorities. A mount can only be initialized once.",
+				},
+			},
+		},
+	}
+}
+
+func (b *backend) readInitStatus(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if !b.isInitialized() {
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"initialized": false,
+			},
+		}, nil
+	}
+
+	systemAttributes, err := b.getEntries(ctx, []string{AuthoritiesPath, SystemAttributes})
+	if err != nil {
+		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+	}
+
+	authorities, err := b.registeredAuthorities(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"initialized":       true,
+			"params_hash":       hex.EncodeToString(b.getParamsHash()),
+			"system_attributes": systemAttributes,
+			"authorities":       authorities,
+		},
+	}, nil
+}
+
+func (b *backend) initialize(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Info("Invoked: Initialization")
+
+	// A concurrent initialization would clear the keys of this one
+	b.initLock.Lock()
+	defer b.initLock.Unlock()
+
+	entry, err := req.Storage.Get(ctx, coreABEGroupKeyPath)
+	if err != nil {
+		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+	}
+	if entry != nil {
+		return logical.ErrorResponse("The ABE Plugin is already initialized"), nil
+	}
 
-		ecElement, params := b.abeGlobalSetup()
+	paramSet := strings.ToLower(data.Get("param_set").(string))
+	customParams := data.Get("params").(string)
 
-		encoded := encodedG{
-			EncodedG: ecElement.CompressedBytes(),
-			Params:   params,
+	// The parameters chosen at config/params are used unless others are given
+	if _, ok := data.GetOk("param_set"); !ok && customParams == "" {
+		config, err := b.getParamsConfig(ctx, req.Storage)
+		if err != nil {
+			return nil, err
 		}
 
-		b.abeCache.SetDefault(abecache, ecElement)
+		paramSet = defaultParamSet
+		if config != nil {
+			paramSet, customParams = config.ParamSet, config.Params
+		}
+	}
 
-		b.dataStore(ctx, encoded, coreABEGroupKeyPath)
+	if customParams != "" && paramSet != paramSetCustom {
+		return logical.ErrorResponse(fmt.Sprintf("params can only be given with the %s parameter set", paramSetCustom)), nil
+	}
 
-		//Create a STATIC DOMAIN-WIDE System-Attribute named SA
-		attributes := []string{"SA"}
-		var majorityInfo majorityConcernsInfo
-		majorityInfo.Attribute = make(map[string]map[string][]string)
+	systemAttributes := []string{}
+	for _, attribute := range data.Get("system_attributes").([]string) {
+		attribute = strings.ToUpper(strings.TrimSpace(attribute))
+		if !plainNameRegex.MatchString(attribute) {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid system attribute name %q", attribute)), nil
+		}
+		if !sliceContains(systemAttributes, attribute) {
+			systemAttributes = append(systemAttributes, attribute)
+		}
+	}
 
+	authorities, err := parseInitialAuthorities(data.Get("authorities").(map[string]interface{}))
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	for authority, attributes := range authorities {
 		for _, attribute := range attributes {
+			if sliceContains(systemAttributes, attribute) {
+				return logical.ErrorResponse(fmt.Sprintf("The attribute %s of the authority %s is a system attribute", attribute, authority)), nil
+			}
+		}
+	}
+
+	encoded, ecElement, g2Element, err := b.abeGlobalSetup(paramSet, customParams)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Invalid pairing parameters: %s", err)), nil
+	}
+
+	// The keys of an earlier initialization that failed were generated with other global parameters
+	if err := b.clearPartialInitialization(ctx); err != nil {
+		return nil, err
+	}
+
+	// The elements are needed to generate the keys, but the mount only counts as initialized once the global parameters are stored
+	b.cacheECElements(ecElement, g2Element)
+
+	initialized := false
+	defer func() {
+		if initialized {
+			return
+		}
+		b.uncacheEC()
+		if err := b.clearPartialInitialization(ctx); err != nil {
+			b.Logger().Error("error clearing the keys of a failed initialization", "error", err)
+		}
+	}()
+
+	for _, attribute := range systemAttributes {
+		if err := b.addSystemAttribute(ctx, newSystemAttributeInfo(attribute)); err != nil {
+			return nil, errwrap.Wrapf("failed to generate the keys of the system attributes: {{err}}", err)
+		}
+	}
 
-			alpha_i, y_i := ecElement.Pairing().NewZr(), ecElement.Pairing().NewZr()
-			alpha_i.Rand()
-			y_i.Rand()
+	authoritiesData := make(map[string]interface{})
 
-			e_gg_alpha_i := ecElement.Pairing().NewGT().Pair(ecElement, ecElement).ThenPowZn(alpha_i)
-			g_y_i := ecElement.Pairing().NewG1().Set(ecElement).ThenPowZn(y_i)
+	for authority, attributes := range authorities {
+		resp, err := b.setupAuthority(ctx, authority, attributes, []string{})
+		if err != nil {
+			return nil, err
+		}
+		if resp.IsError() {
+			return resp, nil
+		}
+		authoritiesData[authority] = resp.Data["generated_data"]
+	}
 
-			publishedData := &keysData{
-				Attribute: attribute,
-				Alphai:    e_gg_alpha_i.Bytes(),
-				Yi:        g_y_i.Bytes(),
+	// The global parameters are stored last: the keys of a mount whose initialization failed are cleared, so that it can be initialized again
+	if err := b.dataStore(ctx, *encoded, coreABEGroupKeyPath); err != nil {
+		return nil, err
+	}
+
+	b.cacheEC(ecElement, g2Element, encoded.Params)
+	initialized = true
+
+	if _, err := b.loadAttributeIndex(ctx); err != nil {
+		b.Logger().Error("error loading the attribute index", "error", err)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"params_hash":       hex.EncodeToString(paramsHash(encoded.Params)),
+			"system_attributes": systemAttributes,
+			"authorities":       authoritiesData,
+		},
+	}, nil
+}
+
+// parseInitialAuthorities reads the `authorities` field of config/init, whose values are either lists of attributes
+// or comma-separated attributes
+func parseInitialAuthorities(raw map[string]interface{}) (map[string][]string, error) {
+	authorities := make(map[string][]string)
+
+	for authority, rawAttributes := range raw {
+		if !plainNameRegex.MatchString(authority) || strings.EqualFold(authority, SystemAttributes) || strings.EqualFold(authority, CommonAttributes) {
+			return nil, fmt.Errorf("Invalid authority name %q", authority)
+		}
+
+		var attributes []string
+
+		switch value := rawAttributes.(type) {
+		case string:
+			attributes = strings.Split(value, ",")
+		case []interface{}:
+			for _, attribute := range value {
+				attributeName, ok := attribute.(string)
+				if !ok {
+					return nil, fmt.Errorf("The attributes of the authority %s must be strings", authority)
+				}
+				attributes = append(attributes, attributeName)
 			}
+		default:
+			return nil, fmt.Errorf("The attributes of the authority %s must be a list", authority)
+		}
 
-			privateData := &keysData{
-				Attribute: attribute,
-				Alphai:    alpha_i.Bytes(),
-				Yi:        y_i.Bytes(),
+		for i := range attributes {
+			attributes[i] = strings.ToUpper(strings.TrimSpace(attributes[i]))
+			if !plainNameRegex.MatchString(attributes[i]) {
+				return nil, fmt.Errorf("Invalid attribute name %q for the authority %s", attributes[i], authority)
 			}
+		}
 
-			constructedPath := b.constructPath([]string{AuthoritiesPath, SystemAttributes})
+		if len(attributes) == 0 {
+			return nil, fmt.Errorf("The authority %s has no attributes", authority)
+		}
+
+		authorities[authority] = attributes
+	}
 
-			b.dataKeyStore(ctx, publishedData, privateData, constructedPath, attribute)
+	return authorities, nil
+}
+
+// isInitialized tells whether the global parameters of the mount are stored and loaded.
+// The hash of the parameters is only cached once they are stored, the elements are already cached while the keys of config/init are generated.
+func (b *backend) isInitialized() bool {
+	element, exists := b.abeCache.Get(abecache)
+	_, stored := b.abeCache.Get(abeParamsHashCache)
+
+	return exists && element != nil && stored
+}
 
-			majorityInfo.Attribute[attribute] = make(map[string][]string)
+// requireInitialization wraps the callbacks of every path but config/init and config/params, so that they fail with a clear error
+// until the mount has been initialized
+func (b *backend) requireInitialization(paths []*framework.Path) []*framework.Path {
+	for _, path := range paths {
+		if path.Pattern == initPath || path.Pattern == paramsConfigPath {
+			continue
+		}
 
+		for operation, callback := range path.Callbacks {
+			path.Callbacks[operation] = b.initializedOnly(callback)
 		}
-		b.dataStore(ctx, majorityInfo, majorityConcernsDir)
 
-	} else {
-		b.Logger().Info("Initialization error", "the plugin is already initialized!")
-		ecElement, _ := b.loadEC(ctx)
-		b.abeCache.SetDefault(abecache, ecElement)
+		for _, handler := range path.Operations {
+			if pathOperation, ok := handler.(*framework.PathOperation); ok {
+				pathOperation.Callback = b.initializedOnly(pathOperation.Callback)
+			}
+		}
+	}
+
+	return paths
+}
+
+func (b *backend) initializedOnly(callback framework.OperationFunc) framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+		if !b.isInitialized() {
+			return logical.ErrorResponse("The ABE Plugin is not initialized, write to " + initPath + " first"), nil
+		}
+
+		return callback(ctx, req, data)
+	}
+}
+
+// cacheEC makes the generators of the global parameters available to the rest of the backend
+func (b *backend) cacheEC(ecElement *pbc.Element, g2Element *pbc.Element, params []byte) {
+	b.cacheECElements(ecElement, g2Element)
+	b.abeCache.SetDefault(abeParamsHashCache, paramsHash(params))
+}
+
+func (b *backend) cacheECElements(ecElement *pbc.Element, g2Element *pbc.Element) {
+	b.abeCache.SetDefault(abecache, ecElement)
+	b.abeCache.SetDefault(abeG2Cache, g2Element)
+	b.invalidateGeneratorTables()
+}
+
+// uncacheEC forgets the elements of an initialization that failed
+func (b *backend) uncacheEC() {
+	b.abeCache.Delete(abecache)
+	b.abeCache.Delete(abeG2Cache)
+	b.abeCache.Delete(abeParamsHashCache)
+	b.invalidateGeneratorTables()
+}
+
+// clearPartialInitialization deletes what config/init writes before the global parameters, for a mount that is not initialized
+func (b *backend) clearPartialInitialization(ctx context.Context) error {
+	if err := logical.ClearView(ctx, logical.NewStorageView(b.storage, AuthoritiesPath+"/")); err != nil {
+		return errwrap.Wrapf("failed to delete: {{err}}", err)
 	}
 
 	return nil
 }
+
+// storeSystemAttributeKeys generates and stores the given version of the keys of a system attribute
+func (b *backend) storeSystemAttributeKeys(ctx context.Context, attribute string, version int) error {
+	_, err := b.generateAttributeKeys(ctx, SystemAttributes, attribute, version)
+	return err
+}
@@ -0,0 +1,283 @@
+package abe
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Nik-U/pbc"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/helper/jsonutil"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// The keys of an attribute are stored under AuthoritiesPath/<entry>/<attribute>, the entry being an authority,
+// CommonAttributes or SystemAttributes. The private keys of its previous versions are kept under
+// AuthoritiesPath/<entry>/<attribute>/VERSIONS/<version>, for as long as they may decrypt.
+
+func attributeKeysPath(entry string, attribute string) string {
+	return AuthoritiesPath + "/" + entry + "/" + attribute
+}
+
+func attributeVersionPath(entry string, attribute string, version int) string {
+	return attributeKeysPath(entry, attribute) + "/" + keyVersionsDir + "/" + strconv.Itoa(version)
+}
+
+// policyAttributeName returns the name of an attribute in the policies (and in the index)
+func policyAttributeName(entry string, attribute string) string {
+	if entry == SystemAttributes || entry == CommonAttributes {
+		return attribute
+	}
+	return attribute + "[" + strings.ToUpper(entry) + "]"
+}
+
+// loadCurrentAttributeKeys returns the private keys of the current version of an attribute, or nil if the attribute does not exist
+func (b *backend) loadCurrentAttributeKeys(ctx context.Context, entry string, attribute string) (*keysData, error) {
+	out, err := b.storage.Get(ctx, attributeKeysPath(entry, attribute)+"/"+publicAccessor)
+	if err != nil {
+		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+	}
+	if out == nil {
+		return nil, nil
+	}
+
+	var data keysData
+	if err := jsonutil.DecodeJSON(out.Value, &data); err != nil {
+		return nil, errwrap.Wrapf("json decoding failed: {{err}}", err)
+	}
+	data.Version = data.keyVersion()
+
+	return &data, nil
+}
+
+// loadAttributeKeys returns the private keys of the given version of an attribute, or nil if that version does not exist (anymore)
+func (b *backend) loadAttributeKeys(ctx context.Context, entry string, attribute string, version int) (*keysData, error) {
+	current, err := b.loadCurrentAttributeKeys(ctx, entry, attribute)
+	if err != nil || current == nil || current.Version == version {
+		return current, err
+	}
+
+	out, err := b.storage.Get(ctx, attributeVersionPath(entry, attribute, version))
+	if err != nil {
+		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+	}
+	if out == nil {
+		return nil, nil
+	}
+
+	var data keysData
+	if err := jsonutil.DecodeJSON(out.Value, &data); err != nil {
+		return nil, errwrap.Wrapf("json decoding failed: {{err}}", err)
+	}
+
+	return &data, nil
+}
+
+// previousAttributeVersions returns the previous versions of an attribute that are kept, in increasing order
+func (b *backend) previousAttributeVersions(ctx context.Context, entry string, attribute string) ([]int, error) {
+	entries, err := b.storage.List(ctx, attributeKeysPath(entry, attribute)+"/"+keyVersionsDir+"/")
+	if err != nil {
+		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+	}
+
+	versions := make([]int, 0, len(entries))
+	for _, versionEntry := range entries {
+		version, err := strconv.Atoi(versionEntry)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+
+	return versions, nil
+}
+
+// generateAttributeKeys generates, stores and indexes the given version of the keys of an attribute, and returns its private keys
+func (b *backend) generateAttributeKeys(ctx context.Context, entry string, attribute string, version int) (*keysData, error) {
+	ecElement := b.getABEElement()
+	generatorTables := b.getGeneratorTables()
+
+	alpha_i, y_i := ecElement.Pairing().NewZr(), ecElement.Pairing().NewZr()
+	alpha_i.Rand()
+	y_i.Rand()
+
+	e_gg_alpha_i := ecElement.Pairing().NewGT().PowerZn(generatorTables.eggPower, alpha_i)
+	g_y_i := ecElement.Pairing().NewG2().PowerZn(generatorTables.hPower, y_i)
+
+	publishedData := &keysData{
+		Attribute: attribute,
+		Alphai:    e_gg_alpha_i.Bytes(),
+		Yi:        g_y_i.Bytes(),
+		Version:   version,
+	}
+
+	privateData := &keysData{
+		Attribute: attribute,
+		Alphai:    alpha_i.Bytes(),
+		Yi:        y_i.Bytes(),
+		Version:   version,
+	}
+
+	constructedPath := b.constructPath([]string{AuthoritiesPath, entry})
+
+	if err := b.dataKeyStore(ctx, publishedData, privateData, constructedPath, attribute); err != nil {
+		return nil, err
+	}
+
+	b.indexAttributeKey(policyAttributeName(entry, attribute), *publishedData)
+
+	return privateData, nil
+}
+
+// rotateAttributeKeys replaces the keys of an attribute with a new version, and returns its private keys.
+// The previous versions are either kept, so that the existing cryptograms can still be decrypted, or all deleted.
+func (b *backend) rotateAttributeKeys(ctx context.Context, entry string, attribute string, keepPrevious bool) (*keysData, error) {
+	current, err := b.loadCurrentAttributeKeys(ctx, entry, attribute)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return nil, fmt.Errorf("the attribute %s has no keys", attribute)
+	}
+
+	if keepPrevious {
+		// The archive is written first, so that a failed rotation never loses the keys of the existing cryptograms
+		archive, err := logical.StorageEntryJSON(attributeVersionPath(entry, attribute, current.Version), current)
+		if err != nil {
+			return nil, errwrap.Wrapf("json encoding failed: {{err}}", err)
+		}
+		if err := b.storage.Put(ctx, archive); err != nil {
+			return nil, errwrap.Wrapf("failed to write: {{err}}", err)
+		}
+	} else {
+		versions, err := b.previousAttributeVersions(ctx, entry, attribute)
+		if err != nil {
+			return nil, err
+		}
+		for _, version := range versions {
+			if err := b.storage.Delete(ctx, attributeVersionPath(entry, attribute, version)); err != nil {
+				return nil, errwrap.Wrapf("failed to delete: {{err}}", err)
+			}
+		}
+	}
+
+	return b.generateAttributeKeys(ctx, entry, attribute, current.Version+1)
+}
+
+// lockAttributes serializes the changes to the keys of attributes (named as in the policies): keygen, rotations and revocations.
+// It returns the function that releases the locks.
+func (b *backend) lockAttributes(attributes ...string) func() {
+	keys := make([]string, len(attributes))
+	for i, attribute := range attributes {
+		keys[i] = strings.ToUpper(attribute)
+	}
+
+	// The locks are returned in a fixed order, so that two calls never wait on each other
+	locks := locksutil.LocksForKeys(b.attributeLocks, keys)
+	for _, lock := range locks {
+		lock.Lock()
+	}
+
+	return func() {
+		for _, lock := range locks {
+			lock.Unlock()
+		}
+	}
+}
+
+// lockGID serializes the changes to the record of a GID, which holds the keys of all its attributes: the attribute locks
+// are taken first, when both are needed. It returns the function that releases the lock.
+func (b *backend) lockGID(GID string) func() {
+	lock := locksutil.LockForKey(b.gidLocks, GID)
+	lock.Lock()
+
+	return lock.Unlock
+}
+
+// userAttributeKey returns the key of an attribute for a GID: g^alpha_i * H(GID)^y_i
+func (b *backend) userAttributeKey(hashedGIDInEC *pbc.Element, private keysData) []byte {
+	ecElement := b.getABEElement()
+
+	alphai := ecElement.Pairing().NewZr().SetBytes(private.Alphai)
+	yi := ecElement.Pairing().NewZr().SetBytes(private.Yi)
+
+	fieldBase := ecElement.Pairing().NewG1()
+	fieldh := ecElement.Pairing().NewG1().Set(hashedGIDInEC).ThenPowZn(yi)
+	fieldR := ecElement.Pairing().NewG1().PowerZn(b.getGeneratorTables().gPower, alphai)
+
+	return fieldBase.Set(fieldR).ThenMul(fieldh).Bytes()
+}
+
+// attributeKey returns the key of the given version of an attribute (named as in the policies), current being
+// the key of the version the GID was last issued, or nil if the GID does not hold that version
+func (data gidData) attributeKey(attribute string, current []byte, version int) []byte {
+	attribute = strings.ToUpper(attribute)
+
+	if version == data.attributeVersion(attribute) {
+		return current
+	}
+
+	return data.PREVIOUS_KEYS[attribute][version]
+}
+
+// attributeVersion returns the version of the current key of a GID for an attribute (named as in the policies)
+func (data gidData) attributeVersion(attribute string) int {
+	if version, ok := data.KEY_VERSIONS[attribute]; ok {
+		return version
+	}
+	return initialKeyVersion
+}
+
+// issuePreviousAttributeKeys records the current version of an attribute for a GID and gives it the keys of the previous versions that are kept
+func (b *backend) issuePreviousAttributeKeys(ctx context.Context, data *gidData, entry string, attribute string, currentVersion int, hashedGIDInEC *pbc.Element) error {
+	policyAttribute := policyAttributeName(entry, attribute)
+
+	versions, err := b.previousAttributeVersions(ctx, entry, attribute)
+	if err != nil {
+		return err
+	}
+
+	previousKeys := make(map[int][]byte)
+	for _, version := range versions {
+		private, err := b.loadAttributeKeys(ctx, entry, attribute, version)
+		if err != nil {
+			return err
+		}
+		if private == nil {
+			continue
+		}
+		previousKeys[version] = b.userAttributeKey(hashedGIDInEC, *private)
+	}
+
+	data.setAttributeVersion(policyAttribute, currentVersion, previousKeys)
+
+	return nil
+}
+
+// setAttributeVersion records the current version of an attribute (named as in the policies) and the keys of its previous versions
+func (data *gidData) setAttributeVersion(attribute string, currentVersion int, previousKeys map[int][]byte) {
+	if data.KEY_VERSIONS == nil {
+		data.KEY_VERSIONS = make(map[string]int)
+	}
+	data.KEY_VERSIONS[attribute] = currentVersion
+
+	if len(previousKeys) == 0 {
+		delete(data.PREVIOUS_KEYS, attribute)
+		return
+	}
+
+	if data.PREVIOUS_KEYS == nil {
+		data.PREVIOUS_KEYS = make(map[string]map[int][]byte)
+	}
+	data.PREVIOUS_KEYS[attribute] = previousKeys
+}
+
+// forgetAttribute removes every version of the keys of an attribute (named as in the policies) from the record of the versions
+func (data *gidData) forgetAttribute(attribute string) {
+	delete(data.KEY_VERSIONS, attribute)
+	delete(data.PREVIOUS_KEYS, attribute)
+}
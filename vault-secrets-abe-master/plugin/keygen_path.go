@@ -3,11 +3,11 @@ package abe
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/sdk/framework"
-	"github.com/hashicorp/vault/sdk/helper/jsonutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
@@ -60,7 +60,7 @@ func pathKeygenSetup(b *backend) []*framework.Path {
 				},
 				"authorities": {
 					Type:        framework.TypeStringSlice,
-					Description: "The authorities to give the attribute to",
+					Description: "The authorities to give the attribute to, each through its own proposal (see " + sysProposalsPath + ")",
 					Required:    true,
 				},
 			},
@@ -70,14 +70,6 @@ func pathKeygenSetup(b *backend) []*framework.Path {
 				logical.CreateOperation: b.systemAttributesKeygen,
 			},
 		},
-		{
-			Pattern: majorityConcernsDir,
-
-			Callbacks: map[logical.Operation]framework.OperationFunc{
-				logical.ReadOperation: b.handleRead,
-				logical.ListOperation: b.handleList,
-			},
-		},
 		{
 			Pattern: genpath + "/?$",
 
@@ -96,7 +88,7 @@ func pathKeygenSetup(b *backend) []*framework.Path {
 			Pattern: genpath + keypathGids + framework.GenericNameRegex("USER"),
 			Fields: map[string]*framework.FieldSchema{
 				"path": {
-					Type: framework.TypeString,
+					Type:        framework.TypeString,
 					Description: `[Required for all types]	Name of the role being created.`,
 				},
 			},
@@ -128,6 +120,17 @@ func (b *backend) keygen(ctx context.Context, req *logical.Request, data *framew
 		commonAttrs[i] = strings.ToUpper(commonAttrs[i])
 	}
 
+	lockedAttributes := []string{}
+	for _, attribute := range authorityAttrs {
+		lockedAttributes = append(lockedAttributes, policyAttributeName(authority, attribute))
+	}
+	for _, attribute := range commonAttrs {
+		lockedAttributes = append(lockedAttributes, policyAttributeName(CommonAttributes, attribute))
+	}
+	// A rotation or a revocation in between would leave the GID with an outdated version
+	defer b.lockAttributes(lockedAttributes...)()
+	defer b.lockGID(GID)()
+
 	gidData, err := b.loadGIDData(ctx, req, GID)
 	if err != nil {
 		return nil, errwrap.Wrapf("Error with GID data: {{err}}", err)
@@ -168,7 +171,7 @@ func (b *backend) keygen(ctx context.Context, req *logical.Request, data *framew
 	// Should also check if the GID already owns the attributes (this is not essential)
 
 	ecElement := b.getABEElement()
-	
+
 	gidMapper := b.createHashMapper(ecElement)
 	hashedGIDInEC := gidMapper(GID)
 
@@ -176,22 +179,31 @@ func (b *backend) keygen(ctx context.Context, req *logical.Request, data *framew
 		attribute := mergedAttribute.attribute
 		isCommonAttribute := mergedAttribute.isCommon
 
-		alphai, yi, err := b.getKeyData(ctx, req, attribute, authority, isCommonAttribute, false, true)
+		entry := authority
+		if isCommonAttribute {
+			entry = CommonAttributes
+		}
+
+		currentKeys, err := b.loadCurrentAttributeKeys(ctx, entry, attribute)
 		if err != nil {
 			return nil, errwrap.Wrapf("failed: {{err}}", err)
 		}
+		if currentKeys == nil {
+			return logical.ErrorResponse(fmt.Sprintf("Non-existent attributes: %s", attribute)), nil
+		}
 
-		fieldBase := ecElement.Pairing().NewG1()
-		fieldh := ecElement.Pairing().NewG1().Set(hashedGIDInEC).ThenPowZn(yi)
-		fieldR := ecElement.Pairing().NewG1().Set(ecElement).ThenPowZn(alphai)
+		userKey := b.userAttributeKey(hashedGIDInEC, *currentKeys)
 
-		fieldBase.Set(fieldR).ThenMul(fieldh)
+		// The keys of the previous versions that are kept are issued too, for the existing cryptograms
+		if err := b.issuePreviousAttributeKeys(ctx, &gidData, entry, attribute, currentKeys.Version, hashedGIDInEC); err != nil {
+			return nil, err
+		}
 
 		if isCommonAttribute {
 			if gidData.COMMON_ATTRIBUTES == nil {
 				gidData.COMMON_ATTRIBUTES = make(map[string][]byte)
 			}
-			gidData.COMMON_ATTRIBUTES[attribute] = fieldBase.Bytes()
+			gidData.COMMON_ATTRIBUTES[attribute] = userKey
 		} else {
 			if gidData.AUTHORITY_ATTRIBUTES == nil {
 				gidData.AUTHORITY_ATTRIBUTES = make(map[string]map[string][]byte)
@@ -201,11 +213,13 @@ func (b *backend) keygen(ctx context.Context, req *logical.Request, data *framew
 				gidData.AUTHORITY_ATTRIBUTES[authority] = map[string][]byte{}
 			}
 
-			gidData.AUTHORITY_ATTRIBUTES[authority][attribute] = fieldBase.Bytes()
+			gidData.AUTHORITY_ATTRIBUTES[authority][attribute] = userKey
 		}
 	}
 
-	b.dataStore(ctx, gidData, genpath)
+	if err := b.dataStore(ctx, gidData, genpath); err != nil {
+		return nil, err
+	}
 
 	// Return a response only if there were no problems up till this point.
 	return &logical.Response{
@@ -217,125 +231,180 @@ func (b *backend) keygen(ctx context.Context, req *logical.Request, data *framew
 	}, nil
 }
 
+// systemAttributesKeygen casts the approval of an authority on the proposals to give a system attribute to other authorities,
+// opening the proposals that are not open yet: the attribute is only given once a proposal reaches its quorum
 func (b *backend) systemAttributesKeygen(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	authority := data.Get("authority").(string)
 	system_attribute := strings.ToUpper(data.Get("system_attribute").(string))
 	authorities := data.Get("authorities").([]string)
 
+	sysAttributeInfo, err := b.loadSystemAttributeInfo(ctx, system_attribute)
+	if err != nil {
+		return nil, err
+	}
+	if sysAttributeInfo == nil {
+		return logical.ErrorResponse(fmt.Sprintf("The system attribute %s does not exist", system_attribute)), nil
+	}
+	if sysAttributeInfo.Retired {
+		return logical.ErrorResponse(fmt.Sprintf("The system attribute %s is retired", system_attribute)), nil
+	}
+
 	if len(authorities) == 0 {
 		return logical.ErrorResponse(`Provide authorities' names`), nil
-	} else {
-		for i := range authorities {
-			authorities[i] = authorities[i]
-		}
+	}
+
+	registeredAuthorities, err := b.registeredAuthorities(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only registered authorities vote, and only for other registered authorities
+	if !sliceContains(registeredAuthorities, authority) {
+		return logical.ErrorResponse(fmt.Sprintf("%s is not a registered authority", authority)), nil
 	}
 
 	keys := make(map[string]bool) // Check for duplicates and erase
 	var authoritiesList []string
 	for _, entry := range authorities {
+		if !sliceContains(registeredAuthorities, entry) {
+			return logical.ErrorResponse(fmt.Sprintf("%s is not a registered authority", entry)), nil
+		}
+		if entry == authority { // Self-votes are not counted
+			continue
+		}
 		if _, value := keys[entry]; !value {
 			keys[entry] = true
 			authoritiesList = append(authoritiesList, entry)
 		}
 	}
 
-	authorities = authoritiesList
-	authoritiesList = authoritiesList[:0]
+	b.proposalLock.Lock()
+	defer b.proposalLock.Unlock()
+
+	proposals := make(map[string]interface{})
+	votedAuthoritiesUpdated := []string{}
+
+	for _, candidate := range authoritiesList {
+		proposal, err := b.findOpenSysProposal(ctx, req, system_attribute, candidate, proposalActionGrant)
+		if err != nil {
+			return nil, err
+		}
+		if proposal == nil {
+			var resp *logical.Response
+			proposal, resp, err = b.openSysProposal(ctx, req, system_attribute, candidate, proposalActionGrant, authority, defaultProposalTTL)
+			if err != nil {
+				return nil, err
+			}
+			if resp != nil {
+				proposals[candidate] = resp.Data
+				continue
+			}
+		}
 
-	for i, authority := range authorities { // Check for self-vote(s) and, if some exist, erase
-		if authority == req.DisplayName {
-			authorities[i] = authorities[len(authorities)-1]
-			authorities[len(authorities)-1] = ""
-			authorities = authorities[:len(authorities)-1]
+		tally, resp, err := b.applySysProposalBallot(ctx, req, proposal, castSysProposalBallot(authority, true))
+		if err != nil {
+			return nil, err
+		}
+		if resp != nil {
+			proposals[candidate] = resp.Data
 			continue
 		}
-	}
 
-	// for i := range authorities { //Just turn to uppercase...
-	// 	authorities[i] = strings.ToUpper(authorities[i])
-	// }
+		if proposal.Status == proposalStatusApproved {
+			votedAuthoritiesUpdated = append(votedAuthoritiesUpdated, candidate)
+		}
 
-	out, err := b.storage.Get(ctx, majorityConcernsDir)
-	if err != nil {
-		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+		proposals[candidate] = map[string]interface{}{
+			"id":     proposal.ID,
+			"status": proposal.Status,
+			"tally":  tally,
+		}
 	}
 
-	if out == nil {
-		return nil, nil
-	}
+	sort.Strings(votedAuthoritiesUpdated)
 
-	var majorityData majorityConcernsInfo
-	if err := jsonutil.DecodeJSON(out.Value, &majorityData); err != nil {
-		return nil, errwrap.Wrapf("json decoding failed: {{err}}", err)
-	}
-	if majorityData.Attribute == nil || len(majorityData.Attribute) == 0 {
-		return logical.ErrorResponse(`The System does not utilize any System Attributes`), nil
-	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"system_attribute": system_attribute,
+			"authorities:":     votedAuthoritiesUpdated,
+			"proposals":        proposals,
+		},
+	}, nil
+}
 
-	majorityData.Attribute[system_attribute][authority] = authorities
+// grantSystemAttribute gives a system attribute to an authority, returning false if the authority already holds it
+func (b *backend) grantSystemAttribute(ctx context.Context, req *logical.Request, system_attribute string, authority string) (bool, error) {
+	defer b.lockAttributes(system_attribute)()
+	defer b.lockGID(authority)()
 
-	b.dataStore(ctx, majorityData, majorityConcernsDir)
+	gidData, err := b.loadGIDData(ctx, req, authority)
+	if err != nil {
+		return false, errwrap.Wrapf("Error with GID data: {{err}}", err)
+	}
 
-	var counterAuthorities float64
-	counterVotes := make(map[string]int)
+	if sliceContains(gidData.SYSTEM_ATTRIBUTES, system_attribute) {
+		return false, nil
+	}
 
-	for _, authorities := range majorityData.Attribute[system_attribute] {
-		counterAuthorities++
-		for _, authority := range authorities {
-			counterVotes[authority] += 1
-		}
+	if gidData.GID == "" {
+		gidData.GID = authority
 	}
 
-	// majority := math.Round(counterAuthorities/2) + 1
+	// The keys of the system attributes are constructed when they are used (see constructSystemAttribute)
+	gidData.SYSTEM_ATTRIBUTES = append(gidData.SYSTEM_ATTRIBUTES, system_attribute)
+	if err := b.dataStore(ctx, gidData, genpath); err != nil {
+		return false, err
+	}
 
-	ecElement := b.getABEElement()
+	return true, nil
+}
 
-	gidMapper := b.createHashMapper(ecElement)
+// revokeSystemAttribute takes a system attribute away from an authority, returning false if the authority does not hold it.
+// The authorities never hold the keys of the system attributes: sysdecrypt constructs them from the private keys, for the
+// authorities whose SYSTEM_ATTRIBUTES list the attribute, so the revocation rests on that list. The keys are rotated as well,
+// so that the new cryptograms do not share a version with the ones the authority may have had decrypted.
+func (b *backend) revokeSystemAttribute(ctx context.Context, req *logical.Request, system_attribute string, authority string) (bool, error) {
+	defer b.lockAttributes(system_attribute)()
+	defer b.lockGID(authority)()
 
-	alphai, yi, err := b.getKeyData(ctx, req, system_attribute, "", false, true, true)
+	gidData, err := b.loadGIDData(ctx, req, authority)
 	if err != nil {
-		return nil, errwrap.Wrapf("failed: {{err}}", err)
+		return false, errwrap.Wrapf("Error with GID data: {{err}}", err)
 	}
 
-	var votedAuthoritiesUpdated []string
-
-	// The below was commented for Development purposes - Remove for production
-	// for votedAuthority, votes := range counterVotes {
-	// 	if votes >= int(majority) {
-	votedAuthority := authority
-	votedAuthoritiesUpdated = append(votedAuthoritiesUpdated, votedAuthority)
+	if !sliceContains(gidData.SYSTEM_ATTRIBUTES, system_attribute) {
+		return false, nil
+	}
 
-	gidData, err := b.loadGIDData(ctx, req, votedAuthority)
+	// The keys are rotated before the authority loses the attribute, so that a failed revocation can be carried out again
+	sysAttributeInfo, err := b.loadSystemAttributeInfo(ctx, system_attribute)
 	if err != nil {
-		return nil, errwrap.Wrapf("Error with GID data: {{err}}", err)
+		return false, err
 	}
 
-	// if gidData.SYSTEM_ATTRIBUTES[system_attribute] == "" {
-		hashedGIDInEC := gidMapper(authority)
-		fieldBase := ecElement.Pairing().NewG1()
-		fieldh := ecElement.Pairing().NewG1().Set(hashedGIDInEC).ThenPowZn(yi)
-		fieldR := ecElement.Pairing().NewG1().Set(ecElement).ThenPowZn(alphai)
+	revocationConfig, err := b.getRevocationConfig(ctx)
+	if err != nil {
+		return false, err
+	}
 
-		fieldBase.Set(fieldR).ThenMul(fieldh)
+	// Retired attributes are no longer used by new cryptograms
+	if sysAttributeInfo != nil && !sysAttributeInfo.Retired {
+		if _, err := b.rotateAttributeKeys(ctx, SystemAttributes, system_attribute, revocationConfig.PreviousVersions == previousVersionsDecryptOnly); err != nil {
+			return false, errwrap.Wrapf("failed to rotate the system attribute: {{err}}", err)
+		}
+	}
 
-		if gidData.GID == "" {
-			gidData.GID = votedAuthority
+	systemAttributes := []string{}
+	for _, attribute := range gidData.SYSTEM_ATTRIBUTES {
+		if attribute != system_attribute {
+			systemAttributes = append(systemAttributes, attribute)
 		}
+	}
 
-		// if gidData.SYSTEM_ATTRIBUTES == nil {
-		// 	gidData.SYSTEM_ATTRIBUTES = make(map[string]string)
-		// }
-		// gidData.SYSTEM_ATTRIBUTES[system_attribute] = fieldBase.Bytes()
-		gidData.SYSTEM_ATTRIBUTES = append(gidData.SYSTEM_ATTRIBUTES, system_attribute)
-		b.dataStore(ctx, gidData, genpath)
-	// }
-	// 	}
-	// }
+	gidData.SYSTEM_ATTRIBUTES = systemAttributes
+	if err := b.dataStore(ctx, gidData, genpath); err != nil {
+		return false, err
+	}
 
-	return &logical.Response{
-		Data: map[string]interface{}{
-			"system_attribute": system_attribute,
-			"authorities:":     votedAuthoritiesUpdated,
-		},
-	}, nil
+	return true, nil
 }
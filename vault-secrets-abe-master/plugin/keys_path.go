@@ -0,0 +1,249 @@
+package abe
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	keysPath = "keys"
+
+	// keyConfigPath is followed by the name of the attribute in the policies
+	keyConfigPath  = "config/keys/"
+	keyConfigCache = "keyConfig/"
+)
+
+// keyConfig holds the versions of the keys of an attribute that may still be used (0 allows every version)
+type keyConfig struct {
+	MinEncryptionVersion int `json:"min_encryption_version"`
+	MinDecryptionVersion int `json:"min_decryption_version"`
+}
+
+func pathKeys(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: keysPath + "/" + framework.GenericNameRegex("authority") + "/" + framework.GenericNameRegex("attribute"),
+
+			Fields: map[string]*framework.FieldSchema{
+				"authority": {
+					Type:        framework.TypeString,
+					Description: fmt.Sprintf("[Required] The authority of the attribute, `%s` for a common attribute or `%s` for a system attribute", CommonAttributesEndpoint, SystemAttributesEndpoint),
+				},
+				"attribute": {
+					Type:        framework.TypeString,
+					Description: "[Required] The name of the attribute",
+				},
+				"min_encryption_version": {
+					Type:        framework.TypeInt,
+					Description: "The oldest version of the keys new cryptograms may be encrypted with (0 allows every version)",
+				},
+				"min_decryption_version": {
+					Type:        framework.TypeInt,
+					Description: "The oldest version of the keys whose cryptograms may still be decrypted (0 allows every version)",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.readAttributeKeys,
+					Summary:  "Read the versions of the keys of an attribute.",
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.configureAttributeKeys,
+					Summary:  "Configure the versions of the keys of an attribute that may be used.",
+				},
+			},
+		},
+		{
+			Pattern: keysPath + "/" + framework.GenericNameRegex("authority") + "/" + framework.GenericNameRegex("attribute") + "/rotate",
+
+			Fields: map[string]*framework.FieldSchema{
+				"authority": {
+					Type:        framework.TypeString,
+					Description: fmt.Sprintf("[Required] The authority of the attribute, `%s` for a common attribute or `%s` for a system attribute", CommonAttributesEndpoint, SystemAttributesEndpoint),
+				},
+				"attribute": {
+					Type:        framework.TypeString,
+					Description: "[Required] The name of the attribute",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback:    b.rotateAttribute,
+					Summary:     "Rotate the keys of an attribute.",
+					Description: "New cryptograms are encrypted with the new version of the keys, which is issued to every GID that holds the attribute. The previous versions are kept for the existing cryptograms.",
+				},
+			},
+		},
+	}
+}
+
+// getKeyConfig returns the key settings of an attribute (named as in the policies), or the defaults if none have been written
+func (b *backend) getKeyConfig(ctx context.Context, attribute string) (keyConfig, error) {
+	attribute = strings.ToUpper(attribute)
+
+	if cached, exists := b.abeCache.Get(keyConfigCache + attribute); exists {
+		return cached.(keyConfig), nil
+	}
+
+	var config keyConfig
+
+	entry, err := b.storage.Get(ctx, keyConfigPath+attribute)
+	if err != nil {
+		return config, errwrap.Wrapf("read failed: {{err}}", err)
+	}
+
+	if entry != nil {
+		if err := entry.DecodeJSON(&config); err != nil {
+			return config, errwrap.Wrapf("json decoding failed: {{err}}", err)
+		}
+	}
+
+	b.abeCache.SetDefault(keyConfigCache+attribute, config)
+
+	return config, nil
+}
+
+// cryptogramKey returns the key of a GID for the version of an attribute a cryptogram was encrypted with,
+// or nil if the GID does not hold that version or the version may no longer decrypt
+func (b *backend) cryptogramKey(ctx context.Context, data gidData, attribute string, current []byte, cts *cryptogram) ([]byte, error) {
+	version := cts.keyVersion(attribute)
+
+	config, err := b.getKeyConfig(ctx, attribute)
+	if err != nil {
+		return nil, err
+	}
+	if version < config.MinDecryptionVersion {
+		return nil, nil
+	}
+
+	return data.attributeKey(attribute, current, version), nil
+}
+
+func (b *backend) readAttributeKeys(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	entry := attributeEntry(data.Get("authority").(string))
+	attribute := strings.ToUpper(data.Get("attribute").(string))
+	policyAttribute := policyAttributeName(entry, attribute)
+
+	current, err := b.loadCurrentAttributeKeys(ctx, entry, attribute)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return nil, nil
+	}
+
+	versions, err := b.previousAttributeVersions(ctx, entry, attribute)
+	if err != nil {
+		return nil, err
+	}
+	versions = append(versions, current.Version)
+
+	config, err := b.getKeyConfig(ctx, policyAttribute)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"attribute":              policyAttribute,
+			"latest_version":         current.Version,
+			"versions":               versions,
+			"min_encryption_version": config.MinEncryptionVersion,
+			"min_decryption_version": config.MinDecryptionVersion,
+		},
+	}, nil
+}
+
+func (b *backend) configureAttributeKeys(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	entry := attributeEntry(data.Get("authority").(string))
+	attribute := strings.ToUpper(data.Get("attribute").(string))
+	policyAttribute := policyAttributeName(entry, attribute)
+
+	current, err := b.loadCurrentAttributeKeys(ctx, entry, attribute)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return logical.ErrorResponse(fmt.Sprintf("The attribute %s does not exist", policyAttribute)), nil
+	}
+
+	config, err := b.getKeyConfig(ctx, policyAttribute)
+	if err != nil {
+		return nil, err
+	}
+
+	if minEncryptionVersion, ok := data.GetOk("min_encryption_version"); ok {
+		config.MinEncryptionVersion = minEncryptionVersion.(int)
+	}
+	if minDecryptionVersion, ok := data.GetOk("min_decryption_version"); ok {
+		config.MinDecryptionVersion = minDecryptionVersion.(int)
+	}
+
+	switch {
+	case config.MinEncryptionVersion < 0 || config.MinDecryptionVersion < 0:
+		return logical.ErrorResponse("The minimum versions can not be negative"), nil
+	case config.MinEncryptionVersion > current.Version || config.MinDecryptionVersion > current.Version:
+		return logical.ErrorResponse(fmt.Sprintf("The minimum versions can not exceed the latest version (%d)", current.Version)), nil
+	case config.MinEncryptionVersion != 0 && config.MinEncryptionVersion < config.MinDecryptionVersion:
+		return logical.ErrorResponse("min_encryption_version can not be lower than min_decryption_version"), nil
+	}
+
+	storageEntry, err := logical.StorageEntryJSON(keyConfigPath+policyAttribute, config)
+	if err != nil {
+		return nil, errwrap.Wrapf("json encoding failed: {{err}}", err)
+	}
+
+	if err := b.storage.Put(ctx, storageEntry); err != nil {
+		return nil, errwrap.Wrapf("failed to write: {{err}}", err)
+	}
+
+	b.abeCache.SetDefault(keyConfigCache+policyAttribute, config)
+
+	return b.readAttributeKeys(ctx, req, data)
+}
+
+func (b *backend) rotateAttribute(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	entry := attributeEntry(data.Get("authority").(string))
+	attribute := strings.ToUpper(data.Get("attribute").(string))
+
+	defer b.lockAttributes(policyAttributeName(entry, attribute))()
+
+	if entry == SystemAttributes {
+		info, err := b.loadSystemAttributeInfo(ctx, attribute)
+		if err != nil {
+			return nil, err
+		}
+		if info != nil && info.Retired {
+			return logical.ErrorResponse(fmt.Sprintf("The system attribute %s is retired", attribute)), nil
+		}
+	}
+
+	current, err := b.loadCurrentAttributeKeys(ctx, entry, attribute)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return logical.ErrorResponse(fmt.Sprintf("The attribute %s does not exist", policyAttributeName(entry, attribute))), nil
+	}
+
+	currentKeys, err := b.rotateAttributeKeys(ctx, entry, attribute, true)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to rotate the attribute: {{err}}", err)
+	}
+
+	// The keys of the system attributes are constructed when they are used
+	if entry != SystemAttributes {
+		if _, err := b.reissueAttributeKeys(ctx, req, entry, attribute, currentKeys, true, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	return b.readAttributeKeys(ctx, req, data)
+}
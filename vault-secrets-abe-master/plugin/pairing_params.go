@@ -0,0 +1,80 @@
+package abe
+
+import (
+	"fmt"
+
+	"github.com/Nik-U/pbc"
+)
+
+const (
+	// paramSetA512 is the type A (symmetric) parameter set every mount used before the parameters could be chosen
+	paramSetA512 = "type-a-512"
+	// paramSetA1536 is a type A (symmetric) parameter set with a 256-bit group order and a 1536-bit base field
+	paramSetA1536 = "type-a-1536"
+	// paramSetF256 is a type F (asymmetric, Barreto-Naehrig) parameter set with a 256-bit group order
+	paramSetF256 = "type-f-256"
+	// paramSetCustom uses PBC parameters given by the operator
+	paramSetCustom = "custom"
+
+	defaultParamSet = paramSetA512
+)
+
+const typeA512Params = `type a
+	q 8780710799663312522437781984754049815806883199414208211028653399266475630880222957078625179422662221423155858769582317459277713367317481324925129998224791
+	h 12016012264891146079388821366740534204802954401251311822919615131047207289359704531102844802183906537786776
+	r 730750818665451621361119245571504901405976559617
+	exp2 159
+	exp1 107
+	sign1 1
+	sign0 1`
+
+var supportedParamSets = []string{paramSetA512, paramSetA1536, paramSetF256, paramSetCustom}
+
+// generateParams returns the PBC parameters of a parameter set. The type A 1536 and type F sets are generated
+// on the spot, which may take a few seconds.
+func generateParams(paramSet string, customParams string) (*pbc.Params, error) {
+	switch paramSet {
+	case paramSetA512:
+		return pbc.NewParamsFromString(typeA512Params)
+	case paramSetA1536:
+		return pbc.GenerateA(256, 1536), nil
+	case paramSetF256:
+		return pbc.GenerateF(256), nil
+	case paramSetCustom:
+		if customParams == "" {
+			return nil, fmt.Errorf("the %s parameter set requires the PBC parameters", paramSetCustom)
+		}
+		return pbc.NewParamsFromString(customParams)
+	default:
+		return nil, fmt.Errorf("unsupported parameter set %q (supported: %v)", paramSet, supportedParamSets)
+	}
+}
+
+// checkParamSet verifies that a pairing matches the kind of pairing its parameter set promises
+func checkParamSet(paramSet string, pairing *pbc.Pairing) error {
+	switch paramSet {
+	case "", paramSetA512, paramSetA1536:
+		if !pairing.IsSymmetric() {
+			return fmt.Errorf("the parameters of %s must describe a symmetric pairing", paramSet)
+		}
+	case paramSetF256:
+		if pairing.IsSymmetric() {
+			return fmt.Errorf("the parameters of %s must describe an asymmetric pairing", paramSet)
+		}
+	case paramSetCustom:
+	default:
+		return fmt.Errorf("unsupported parameter set %q", paramSet)
+	}
+
+	return nil
+}
+
+// generateGenerators picks the generators g of G1 and h of G2. Symmetric pairings use g for both.
+func generateGenerators(pairing *pbc.Pairing) (*pbc.Element, *pbc.Element) {
+	g := pairing.NewG1().Rand()
+	if pairing.IsSymmetric() {
+		return g, g
+	}
+
+	return g, pairing.NewG2().Rand()
+}
@@ -0,0 +1,62 @@
+package abe
+
+import (
+	"fmt"
+	"sync"
+)
+
+// forEachParallel calls fn for every index in [0, n) on at most `workers` goroutines and returns the error of the
+// lowest failing index. fn must only write to the position of its own index, so that the outcome does not depend on
+// the scheduling of the workers. A panic of fn (e.g. within pbc) is returned as the error of its index, instead of
+// taking the whole plugin down from a worker.
+func forEachParallel(n int, workers int, fn func(i int) error) error {
+	if workers > n {
+		workers = n
+	}
+
+	errs := make([]error, n)
+
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			errs[i] = callRecovered(fn, i)
+		}
+	} else {
+		indexes := make(chan int)
+		var wg sync.WaitGroup
+
+		for worker := 0; worker < workers; worker++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range indexes {
+					errs[i] = callRecovered(fn, i)
+				}
+			}()
+		}
+
+		for i := 0; i < n; i++ {
+			indexes <- i
+		}
+		close(indexes)
+		wg.Wait()
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// callRecovered calls fn for an index, turning a panic into an error
+func callRecovered(fn func(i int) error, i int) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while processing item %d: %v", i, r)
+		}
+	}()
+
+	return fn(i)
+}
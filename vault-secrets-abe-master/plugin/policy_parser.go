@@ -2,8 +2,9 @@ package abe
 
 import (
 	"fmt"
-	"math"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/Nik-U/pbc"
@@ -13,31 +14,40 @@ import (
 
 type node struct {
 	val       string
+	threshold int
 	dup_label int
 	parent    *node
-	left      *node
-	right     *node
+	children  []*node
 }
 
 //val (default="-")is either the optype or attribute (if the node is a leaf)
+//threshold (default=0) is k for a k-of-n threshold gate (OF); AND nodes are n-of-n and OR nodes are 1-of-n
 //dup_label (default=0) is the duplicate index 0 means it is unique, 1 means it isn't unique and that this is the first instance
 //parent (default=nil) is a pointer to the parent node
-//left (default=nil) is a pointer to the left child node
-//right (default=nil) is a pointer to the right child node
+//children (default=nil) are pointers to the child nodes, in the order they appear in the policy
 
-func createPolicy(policy_str string) (tree_root node) {
-
-	tokenized := tokenize(policy_str)
-
-	//Check to see if the tree will only be 1 leaf without nodes
+// policySyntaxError describes where and why a policy string could not be parsed
+type policySyntaxError struct {
+	Position int    `json:"position"`
+	Expected string `json:"expected"`
+	Found    string `json:"found"`
+}
 
-	if oneleaftreecheck(tokenized) {
+func (e *policySyntaxError) Error() string {
+	found := fmt.Sprintf("%q", e.Found)
+	if e.Found == "" {
+		found = "the end of the policy"
+	}
+	return fmt.Sprintf("policy syntax error at token %d: expected %s, found %s", e.Position, e.Expected, found)
+}
 
-		tree_root = oneleaftree(tokenized)
+func createPolicy(policy_str string) (tree_root node, err error) {
 
-	} else {
+	tokenized := tokenize(policy_str)
 
-		tree_root = to_tree(tokenized)
+	tree_root, err = to_tree(tokenized)
+	if err != nil {
+		return
 	}
 
 	dup_dict := make(map[string]int)
@@ -58,7 +68,12 @@ func tokenize(in string) []string {
 	in = strings.ToUpper(in)
 	in = strings.Replace(in, "(", "( ", -1)
 	in = strings.Replace(in, ")", " )", -1)
+	in = strings.Replace(in, ",", " , ", -1)
 	in = space.ReplaceAllString(in, " ")
+	in = strings.TrimSpace(in)
+	if in == "" {
+		return s
+	}
 	out := strings.Split(in, " ")
 
 	for i := 0; i < len(out); i++ {
@@ -71,7 +86,7 @@ func tokenize(in string) []string {
 
 func isOp(in string) bool {
 
-	return ((in == "AND") || (in == "OR"))
+	return ((in == "AND") || (in == "OR") || (in == "OF"))
 
 }
 
@@ -85,6 +100,22 @@ func isOpAnd(in string) bool {
 	return (in == "AND")
 }
 
+func isOpOf(in string) bool {
+
+	return (in == "OF")
+}
+
+func isComma(in string) bool {
+
+	return (in == ",")
+}
+
+func isThreshold(in string) bool {
+
+	k, err := strconv.Atoi(in)
+	return err == nil && k > 0
+}
+
 func isLPar(in string) bool {
 
 	return (in == "(")
@@ -99,85 +130,186 @@ func isRPar(in string) bool {
 
 func isAttr(in string) bool {
 
-	return (!isOp(in) && !isRPar(in) && !isLPar(in))
+	return (!isOp(in) && !isRPar(in) && !isLPar(in) && !isComma(in))
 
 }
 
-func to_tree(in []string) node {
+// attributeRegex accepts `ATTRIBUTE` (common and system attributes) and `ATTRIBUTE[AUTHORITY]` (authority attributes)
+var attributeRegex = regexp.MustCompile(`^[\w\-.]+(\[[\w\-.]+\])?$`)
+
+func isValidAttr(in string) bool {
 
-	root_node := node{"-", 0, nil, nil, nil}
-	root_node.parent = &root_node
+	return isAttr(in) && attributeRegex.MatchString(in)
+}
 
-	current_node := &root_node
+//The policy grammar, from the lowest to the highest precedence:
+//
+//	policy   := or_expr
+//	or_expr  := and_expr { OR and_expr }
+//	and_expr := operand { AND operand }
+//	operand  := ATTRIBUTE | ( or_expr ) | k OF ( or_expr { , or_expr } )
+//
+//AND binds tighter than OR, so `A OR B AND C` means `A OR (B AND C)`, and chains of the same operator become
+//a single n-ary node, so `A AND B AND C` is one 3-of-3 gate
+
+type policyParser struct {
+	tokens []string
+	pos    int
+}
 
-	i := 0
-	for i < len(in) {
+func to_tree(in []string) (node, error) {
 
-		if isLPar(string(in[i])) {
-			//Create child node move and move down
-			if (*current_node).left == nil {
-				(*current_node).left = &node{"-", 0, current_node, nil, nil}
-				current_node = (*current_node).left
-			} else {
-				(*current_node).right = &node{"-", 0, current_node, nil, nil}
-				current_node = (*current_node).right
-			}
-		} else if isRPar(string(in[i])) {
-			//Move up
-			current_node = (*current_node).parent
-		} else if isAttr(string(in[i])) {
-			//Create leaf node but do not enter the leaf
-			if (*current_node).left == nil {
-				(*current_node).left = &node{string(in[i]), 0, current_node, nil, nil}
-			} else {
-				(*current_node).right = &node{string(in[i]), 0, current_node, nil, nil}
-			}
-		} else if isOp(string(in[i])) {
-			//Set node op but do not move
-			(*current_node).val = string(in[i])
-		}
+	parser := &policyParser{tokens: in}
 
-		i++
+	if len(in) == 0 {
+		return node{}, parser.errorf("an attribute")
 	}
 
-	return root_node
+	root_node, err := parser.parseOr(nil)
+	if err != nil {
+		return node{}, err
+	}
+
+	//Everything must have been consumed by the grammar
+	if parser.pos < len(in) {
+		return node{}, parser.errorf("AND, OR or the end of the policy")
+	}
+
+	root_node.parent = root_node
+
+	return *root_node, nil
 }
 
-func oneleaftreecheck(in []string) (result bool) {
-	total := 0
-	result = false
-	for _, v := range in {
-		if !isLPar(v) && !isRPar(v) {
-			total += 1
-		}
+func (p *policyParser) peek() string {
+
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
 	}
-	if total == 1 {
-		result = true
+	return ""
+}
+
+func (p *policyParser) next() string {
+
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+// errorf reports that the token at the current position is not the expected one
+func (p *policyParser) errorf(expected string) error {
+
+	return &policySyntaxError{
+		Position: p.pos,
+		Expected: expected,
+		Found:    p.peek(),
 	}
-	return
 }
 
-func oneleaftree(in []string) node {
+func (p *policyParser) parseOr(parent *node) (*node, error) {
 
-	root_node := node{"-", 0, nil, nil, nil}
-	for i, v := range in {
-		if !isLPar(v) && !isRPar(v) {
-			root_node.val = in[i]
-			root_node.parent = &root_node
+	return p.parseChain(parent, "OR", p.parseAnd)
+}
+
+func (p *policyParser) parseAnd(parent *node) (*node, error) {
+
+	return p.parseChain(parent, "AND", p.parseOperand)
+}
+
+// parseChain parses `operand op operand op ...` and flattens it into one n-ary node (or returns the single operand as is)
+func (p *policyParser) parseChain(parent *node, op string, parseOperand func(*node) (*node, error)) (*node, error) {
+
+	current_node := &node{op, 0, 0, parent, nil}
+
+	for {
+		child, err := parseOperand(current_node)
+		if err != nil {
+			return nil, err
+		}
+		current_node.children = append(current_node.children, child)
+
+		if p.peek() != op {
 			break
 		}
+		p.next()
+	}
+
+	if len(current_node.children) == 1 {
+		child := current_node.children[0]
+		child.parent = parent
+		return child, nil
 	}
-	return root_node
+	return current_node, nil
 }
 
-func find_dups(dict map[string]int, current_node *node) {
-	//Go left
-	if (*current_node).left != nil {
-		find_dups(dict, (*current_node).left)
+func (p *policyParser) parseOperand(parent *node) (*node, error) {
+
+	token := p.peek()
+
+	if isLPar(token) {
+		//Parenthesized sub-policy
+		p.next()
+		current_node, err := p.parseOr(parent)
+		if err != nil {
+			return nil, err
+		}
+		if !isRPar(p.peek()) {
+			return nil, p.errorf("AND, OR or )")
+		}
+		p.next()
+		return current_node, nil
 	}
-	//Go right
-	if (*current_node).right != nil {
-		find_dups(dict, (*current_node).right)
+
+	if isThreshold(token) && p.pos+1 < len(p.tokens) && isOpOf(p.tokens[p.pos+1]) {
+		//Threshold gate: k OF (child_1, ..., child_n)
+		thresholdPosition := p.pos
+		k, _ := strconv.Atoi(p.next())
+		current_node := &node{p.next(), k, 0, parent, nil}
+
+		if !isLPar(p.peek()) {
+			return nil, p.errorf("(")
+		}
+		p.next()
+
+		for {
+			child, err := p.parseOr(current_node)
+			if err != nil {
+				return nil, err
+			}
+			current_node.children = append(current_node.children, child)
+
+			if !isComma(p.peek()) {
+				break
+			}
+			p.next()
+		}
+
+		if !isRPar(p.peek()) {
+			return nil, p.errorf("AND, OR, , or )")
+		}
+		p.next()
+
+		if k > len(current_node.children) {
+			return nil, &policySyntaxError{
+				Position: thresholdPosition,
+				Expected: fmt.Sprintf("a threshold of at most %d", len(current_node.children)),
+				Found:    token,
+			}
+		}
+		return current_node, nil
+	}
+
+	if !isValidAttr(token) {
+		return nil, p.errorf("an attribute, ( or k OF (")
+	}
+
+	//Leaf node
+	return &node{p.next(), 0, 0, parent, nil}, nil
+}
+
+func find_dups(dict map[string]int, current_node *node) {
+	//Go through the children, left to right
+	for _, child := range (*current_node).children {
+		find_dups(dict, child)
 	}
 
 	if isAttr((*current_node).val) {
@@ -206,13 +338,9 @@ func label_dups(dict map[string]int, current_node *node) {
 }
 
 func label_node(dict map[string]int, current_node *node) {
-	//Go left
-	if (*current_node).left != nil {
-		label_node(dict, (*current_node).left)
-	}
-	//Go right
-	if (*current_node).right != nil {
-		label_node(dict, (*current_node).right)
+	//Go through the children, left to right
+	for _, child := range (*current_node).children {
+		label_node(dict, child)
 	}
 
 	if isAttr((*current_node).val) {
@@ -231,9 +359,6 @@ func (root *node) calculateSharesList(pairing *pbc.Element, s *pbc.Element, attr
 
 func (subtree *node) compute_shares(pairing *pbc.Element, s *pbc.Element, attr_list map[string]*pbc.Element) {
 
-	//k is the threshold 1-of-2 (OR) or 2-of-2 (AND nodes)
-	k := 0
-
 	//Empty Node
 	if subtree == nil {
 		return
@@ -246,36 +371,54 @@ func (subtree *node) compute_shares(pairing *pbc.Element, s *pbc.Element, attr_l
 		}
 		attr_list[attr] = s
 		return
-		//Operator Node
-	} else if isOpOr((*subtree).val) {
-		k = 1
-	} else if isOpAnd((*subtree).val) {
-		k = 2
-		//Invalid catch
-	} else {
+	}
+
+	//k is the threshold: 1-of-n (OR), n-of-n (AND) or k-of-n (OF)
+	k, n := subtree.gate()
+
+	//Invalid catch
+	if k == 0 {
 		return
 	}
 
 	//Generate shares
-	shares := genshares(pairing, s, k, 2)
+	shares := genshares(pairing, s, k, n)
 
 	//Recurse
-	(*subtree).left.compute_shares(pairing, shares[1], attr_list)
-	(*subtree).right.compute_shares(pairing, shares[2], attr_list)
+	for i, child := range (*subtree).children {
+		child.compute_shares(pairing, shares[i+1], attr_list)
+	}
+}
+
+// gate returns the threshold k and the number of children n of an operator node (k=0 for anything else)
+func (subtree *node) gate() (k int, n int) {
+
+	n = len((*subtree).children)
+
+	if isOpOr((*subtree).val) {
+		k = 1
+	} else if isOpAnd((*subtree).val) {
+		k = n
+	} else if isOpOf((*subtree).val) {
+		k = (*subtree).threshold
+	}
+
+	if k > n {
+		k = 0
+	}
+	return
 }
 
 func genshares(pairing *pbc.Element, s *pbc.Element, k int, n int) (shares []*pbc.Element) {
 	if k <= n {
 
-		//New Random secret
-		new_s := pairing.Pairing().NewZr().Rand()
-
+		//The polynomial has degree k-1, the secret is its constant term and the rest of the coefficients are random
 		var a []*pbc.Element
 		for i := 0; i < k; i++ {
 			if i == 0 {
 				a = append(a, s)
 			} else {
-				a = append(a, new_s)
+				a = append(a, pairing.Pairing().NewZr().Rand())
 			}
 		}
 		for j := 0; j < (n + 1); j++ {
@@ -288,20 +431,18 @@ func genshares(pairing *pbc.Element, s *pbc.Element, k int, n int) (shares []*pb
 func Pfunc(coeff []*pbc.Element, x int, pairing *pbc.Element) (out_share *pbc.Element) {
 	//set to 0
 	out_share = pairing.Pairing().NewZr().Set0()
+	x_el := pairing.Pairing().NewZr().SetInt32(int32(x))
+	x_pow := pairing.Pairing().NewZr().Set1()
 	//Evaluate Polynomial
 	for i := 0; i < len(coeff); i++ {
 
-		res := pairing.Pairing().NewZr().Rand()
-		res.MulInt32(coeff[i], powInt(x, i))
+		res := pairing.Pairing().NewZr().Mul(coeff[i], x_pow)
 		out_share.Add(out_share, res)
+		x_pow.ThenMul(x_el)
 	}
 	return
 }
 
-func powInt(x, y int) int32 {
-	return int32(math.Pow(float64(x), float64(y)))
-}
-
 func (subtree *node) getAttributeTraverse(aList *[]string) {
 
 	//Empty Node
@@ -317,8 +458,9 @@ func (subtree *node) getAttributeTraverse(aList *[]string) {
 		(*aList) = append((*aList), attr)
 	} else {
 		//Recurse
-		(*subtree).left.getAttributeTraverse(aList)
-		(*subtree).right.getAttributeTraverse(aList)
+		for _, child := range (*subtree).children {
+			child.getAttributeTraverse(aList)
+		}
 	}
 
 	return
@@ -329,36 +471,203 @@ func (root *node) getAttributeList() (aList []string) {
 	return
 }
 
-func (root *node) getCoefficients(pairing *pbc.Element, coeff_list map[string]*pbc.Element) {
+// uniqueAttributes returns the attributes of the policy once each, without the duplicate labels
+func (root *node) uniqueAttributes() (aList []string) {
+	seen := make(map[string]bool)
+	for _, attr := range root.leaves() {
+		if !seen[attr.val] {
+			seen[attr.val] = true
+			aList = append(aList, attr.val)
+		}
+	}
+	return
+}
+
+func (subtree *node) leaves() (leaves []*node) {
+	if subtree == nil {
+		return
+	}
+	if !isOp((*subtree).val) {
+		return []*node{subtree}
+	}
+	for _, child := range (*subtree).children {
+		leaves = append(leaves, child.leaves()...)
+	}
+	return
+}
+
+// policyAST is the JSON representation of a parsed policy
+type policyAST struct {
+	Type      string       `json:"type"`
+	Attribute string       `json:"attribute,omitempty"`
+	Label     string       `json:"label,omitempty"`
+	DupLabel  int          `json:"dup_label,omitempty"`
+	Threshold int          `json:"threshold,omitempty"`
+	Children  []*policyAST `json:"children,omitempty"`
+}
+
+func (subtree *node) toAST() *policyAST {
+	if !isOp((*subtree).val) {
+		label := (*subtree).val
+		if (*subtree).dup_label > 0 {
+			label = fmt.Sprintf("%s_%d", label, (*subtree).dup_label-1)
+		}
+		return &policyAST{
+			Type:      "ATTRIBUTE",
+			Attribute: (*subtree).val,
+			Label:     label,
+			DupLabel:  (*subtree).dup_label,
+		}
+	}
+
+	k, _ := subtree.gate()
+	ast := &policyAST{
+		Type:      (*subtree).val,
+		Threshold: k,
+	}
+	for _, child := range (*subtree).children {
+		ast.Children = append(ast.Children, child.toAST())
+	}
+	return ast
+}
+
+// String returns the normalised form of the policy, which createPolicy parses back to the same tree
+func (subtree *node) String() string {
+	if !isOp((*subtree).val) {
+		return (*subtree).val
+	}
+
+	var children []string
+	for _, child := range (*subtree).children {
+		childStr := child.String()
+		if !isOpOf((*subtree).val) && (isOpAnd(child.val) || isOpOr(child.val)) {
+			childStr = "(" + childStr + ")"
+		}
+		children = append(children, childStr)
+	}
+
+	if isOpOf((*subtree).val) {
+		return fmt.Sprintf("%d OF (%s)", (*subtree).threshold, strings.Join(children, ", "))
+	}
+	return strings.Join(children, " "+(*subtree).val+" ")
+}
+
+// getCoefficients assigns to every leaf that takes part in the reconstruction the product of the Lagrange coefficients on its path to the root.
+// The attributes must be the ones prune picked from the same policy, so that every threshold gate is reconstructed from the children they satisfy.
+func (root *node) getCoefficients(pairing *pbc.Element, coeff_list map[string]*pbc.Element, attributes []string) error {
+
+	leaves := root.reconstructionLeaves(attributes)
+	for _, attr := range attributes {
+		if !searchSlice(leaves, attr) {
+			return fmt.Errorf("the attribute %s takes no part in the reconstruction of the policy", attr)
+		}
+	}
 
 	coeff := pairing.Pairing().NewZr().Set1()
-	root.getCoefficientsMap(pairing, coeff_list, coeff)
+	root.getCoefficientsMap(pairing, coeff_list, coeff, attributes)
+	return nil
 }
 
-func (subtree *node) getCoefficientsMap(pairing *pbc.Element, coeff_list map[string]*pbc.Element, coeff *pbc.Element) {
+// getCoefficientsMap assigns to every leaf the product of the Lagrange coefficients on its path to the root
+// For a k-of-n gate with k > 1 the coefficients depend on which k children take part in the reconstruction (see reconstructionChildren)
+func (subtree *node) getCoefficientsMap(pairing *pbc.Element, coeff_list map[string]*pbc.Element, coeff *pbc.Element, attributes []string) {
 	//Empty Node
 	if subtree == nil {
 		return
 	}
 	//Leaf Node
 	if !isOp((*subtree).val) {
-		attr := (*subtree).val
-		if (*subtree).dup_label > 0 {
-			attr = fmt.Sprintf("%s_%d", attr, (*subtree).dup_label-1)
+		coeff_list[subtree.label()] = coeff
+		return
+	}
+
+	indices := subtree.reconstructionChildren(attributes)
+	if len(indices) == 0 {
+		return
+	}
+
+	var lagrange map[int]*pbc.Element
+	if k, _ := subtree.gate(); k > 1 {
+		lagrange = recoverCoefficients(pairing, indices)
+	}
+
+	for _, index := range indices {
+		childCoeff := coeff
+		//Any single child recovers the secret with a coefficient of 1
+		if lagrange != nil {
+			childCoeff = pairing.Pairing().NewZr().Set0().Mul(coeff, lagrange[int(index)])
 		}
-		coeff_list[attr] = coeff
+		(*subtree).children[index-1].getCoefficientsMap(pairing, coeff_list, childCoeff, attributes)
+	}
+}
+
+// reconstructionChildren returns the (1-based) indices of the children of a gate that take part in its reconstruction:
+// every child for a 1-of-n gate (they all share the secret as is) and the k children satisfiedChildren picks otherwise
+func (subtree *node) reconstructionChildren(attributes []string) (indices []int32) {
+
+	k, _ := subtree.gate()
+
+	//Invalid catch
+	if k == 0 {
 		return
-		//Operator Node
-	} else if isOpOr((*subtree).val) {
-		(*subtree).left.getCoefficientsMap(pairing, coeff_list, pairing.Pairing().NewZr().Set0().Mul(coeff, recoverCoefficients(pairing, []int32{1})[1]))
-		(*subtree).right.getCoefficientsMap(pairing, coeff_list, pairing.Pairing().NewZr().Set0().Mul(coeff, recoverCoefficients(pairing, []int32{1})[1]))
-	} else if isOpAnd((*subtree).val) {
-		(*subtree).left.getCoefficientsMap(pairing, coeff_list, pairing.Pairing().NewZr().Set0().Mul(coeff, recoverCoefficients(pairing, []int32{1, 2})[1]))
-		(*subtree).right.getCoefficientsMap(pairing, coeff_list, pairing.Pairing().NewZr().Set0().Mul(coeff, recoverCoefficients(pairing, []int32{1, 2})[2]))
-		//Invalid catch
-	} else {
+	}
+
+	if k == 1 {
+		for i := range (*subtree).children {
+			indices = append(indices, int32(i+1))
+		}
+		return
+	}
+
+	return subtree.satisfiedChildren(attributes, k)
+}
+
+// reconstructionLeaves returns the (labelled) leaves that getCoefficients assigns a coefficient to for the given attributes
+func (subtree *node) reconstructionLeaves(attributes []string) (leaves []string) {
+	//Empty Node
+	if subtree == nil {
 		return
 	}
+	//Leaf Node
+	if !isOp((*subtree).val) {
+		return []string{subtree.label()}
+	}
+
+	for _, index := range subtree.reconstructionChildren(attributes) {
+		leaves = append(leaves, (*subtree).children[index-1].reconstructionLeaves(attributes)...)
+	}
+	return
+}
+
+// label returns the name of a leaf in the cryptograms, which tells the duplicate attributes apart
+func (subtree *node) label() string {
+	if (*subtree).dup_label > 0 {
+		return fmt.Sprintf("%s_%d", (*subtree).val, (*subtree).dup_label-1)
+	}
+	return (*subtree).val
+}
+
+// satisfiedChildren returns the (1-based) indices of the first k children satisfied by the attributes
+// If fewer than k children are satisfied, the remaining indices are filled in order, as the node can not be reconstructed anyway
+func (subtree *node) satisfiedChildren(attributes []string, k int) (indices []int32) {
+
+	var unsatisfied []int32
+
+	for i, child := range (*subtree).children {
+		if satisfied, _ := child.requiredAttributes(attributes); satisfied && len(indices) < k {
+			indices = append(indices, int32(i+1))
+		} else {
+			unsatisfied = append(unsatisfied, int32(i+1))
+		}
+	}
+
+	for _, index := range unsatisfied {
+		if len(indices) == k {
+			break
+		}
+		indices = append(indices, index)
+	}
+	return
 }
 
 func recoverCoefficients(pairing *pbc.Element, list []int32) (this_coeff map[int]*pbc.Element) {
@@ -390,6 +699,9 @@ func recoverCoefficients(pairing *pbc.Element, list []int32) (this_coeff map[int
 	return
 }
 
+// prune returns the attributes, among the given ones, that take part in the decryption: the first k satisfied children of every gate.
+// A decryption must prune all the attributes it uses (system and user ones alike) at once, on the policy of the cryptogram,
+// as the coefficients of the threshold gates depend on the children that are picked.
 func (root *node) prune(attributes []string) (policySatisfied bool, prunedList []string) {
 
 	policySatisfied, prunedList = root.requiredAttributes(attributes)
@@ -414,33 +726,69 @@ func (subtree *node) requiredAttributes(attributes []string) (policySatisfied bo
 			prunedList = []string{attr}
 		}
 		//Operator Node
-	} else if isOpOr((*subtree).val) {
-		//Either child needs to return true  for this node to return true
+	} else if k, _ := subtree.gate(); k > 0 {
+		//At least k of the children need to return true for this node to return true (1 for OR, all of them for AND)
 
-		leftPol, leftPrune := (*subtree).left.requiredAttributes(attributes)
-		rightPol, rightPrune := (*subtree).right.requiredAttributes(attributes)
+		satisfiedChildren := 0
+		var childrenPrune []string
 
-		if leftPol {
-			policySatisfied = true
-			prunedList = append(prunedList, leftPrune...)
-		} else if rightPol {
-			policySatisfied = true
-			prunedList = append(prunedList, rightPrune...)
+		for _, child := range (*subtree).children {
+			childPol, childPrune := child.requiredAttributes(attributes)
+			if childPol {
+				satisfiedChildren++
+				childrenPrune = append(childrenPrune, childPrune...)
+			}
+			if satisfiedChildren == k {
+				policySatisfied = true
+				prunedList = childrenPrune
+				break
+			}
 		}
-	} else if isOpAnd((*subtree).val) {
-		//Both children need to return true for this node to return true
+	}
+	return
 
-		leftPol, leftPrune := (*subtree).left.requiredAttributes(attributes)
-		rightPol, rightPrune := (*subtree).right.requiredAttributes(attributes)
+}
 
-		if leftPol && rightPol {
-			policySatisfied = true
-			prunedList = append(prunedList, leftPrune...)
-			prunedList = append(prunedList, rightPrune...)
+// missingAttributes returns a set of attributes, besides the given ones, that would satisfy the policy
+// For every gate it keeps the k children that are the cheapest to satisfy, which gives the smallest set when no attribute
+// appears twice in the policy (as in the policies of the cryptograms); otherwise the children may share attributes and the set may not be minimal
+func (subtree *node) missingAttributes(attributes []string) (missingList []string) {
+
+	//Empty Node
+	if subtree == nil {
+		return
+	}
+	//Leaf Node
+	if !isOp((*subtree).val) {
+		if !searchSlice(attributes, (*subtree).val) {
+			missingList = []string{(*subtree).val}
 		}
+		return
 	}
-	return
 
+	k, _ := subtree.gate()
+
+	//Invalid catch
+	if k == 0 {
+		return
+	}
+
+	var childrenMissing [][]string
+	for _, child := range (*subtree).children {
+		childrenMissing = append(childrenMissing, child.missingAttributes(attributes))
+	}
+	sort.SliceStable(childrenMissing, func(i, j int) bool {
+		return len(childrenMissing[i]) < len(childrenMissing[j])
+	})
+
+	for _, childMissing := range childrenMissing[:k] {
+		for _, attr := range childMissing {
+			if !searchSlice(missingList, attr) {
+				missingList = append(missingList, attr)
+			}
+		}
+	}
+	return
 }
 
 func searchSlice(list []string, element string) (result bool) {
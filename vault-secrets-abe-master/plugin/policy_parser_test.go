@@ -0,0 +1,213 @@
+package abe
+
+import (
+	"sort"
+	"testing"
+)
+
+// The system attributes (SA, SB) and the user attributes of a decryption are pruned together, so that every
+// threshold gate is reconstructed from the same children and every pruned attribute is given a coefficient
+func TestPruneThresholdGates(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    string
+		system    []string
+		user      []string
+		satisfied bool
+		pruned    []string
+	}{
+		{
+			name:      "system and user children of a gate",
+			policy:    "2 OF (A, SA, B)",
+			system:    []string{"SA"},
+			user:      []string{"B"},
+			satisfied: true,
+			pruned:    []string{"B", "SA"},
+		},
+		{
+			name:      "every child available",
+			policy:    "2 OF (A, SA, B)",
+			system:    []string{"SA"},
+			user:      []string{"A", "B"},
+			satisfied: true,
+			pruned:    []string{"A", "SA"},
+		},
+		{
+			name:      "system attribute below a gate",
+			policy:    "2 OF (A, B, (C AND SA))",
+			system:    []string{"SA"},
+			user:      []string{"A", "C"},
+			satisfied: true,
+			pruned:    []string{"A", "C", "SA"},
+		},
+		{
+			name:      "system attribute below a gate left out",
+			policy:    "2 OF (A, B, (C AND SA))",
+			system:    []string{"SA"},
+			user:      []string{"A", "B", "C"},
+			satisfied: true,
+			pruned:    []string{"A", "B"},
+		},
+		{
+			name:      "system attributes only",
+			policy:    "2 OF (SA, SB, A) AND B",
+			system:    []string{"SA", "SB"},
+			user:      []string{"B"},
+			satisfied: true,
+			pruned:    []string{"B", "SA", "SB"},
+		},
+		{
+			name:      "nested gates",
+			policy:    "3 OF (A, (SA OR B), C[AUTH], SB)",
+			system:    []string{"SA", "SB"},
+			user:      []string{"B", "C[AUTH]"},
+			satisfied: true,
+			pruned:    []string{"C[AUTH]", "SA", "SB"},
+		},
+		{
+			name:      "too few children",
+			policy:    "2 OF (A, SA, B)",
+			system:    []string{"SA"},
+			satisfied: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy, err := createPolicy(test.policy)
+			if err != nil {
+				t.Fatalf("createPolicy(%q): %v", test.policy, err)
+			}
+
+			satisfied, pruned := policy.prune(append(append([]string{}, test.system...), test.user...))
+			if satisfied != test.satisfied {
+				t.Fatalf("satisfied = %v, want %v", satisfied, test.satisfied)
+			}
+			if !satisfied {
+				return
+			}
+
+			sort.Strings(pruned)
+			if !equalStrings(pruned, test.pruned) {
+				t.Fatalf("pruned = %v, want %v", pruned, test.pruned)
+			}
+
+			leaves := policy.reconstructionLeaves(pruned)
+			for _, attribute := range pruned {
+				if !searchSlice(leaves, attribute) {
+					t.Errorf("%s is pruned but has no coefficient (reconstructed leaves %v)", attribute, leaves)
+				}
+			}
+		})
+	}
+}
+
+// Attributes that were not pruned on the policy are refused before any coefficient is computed
+func TestGetCoefficientsRejectsUnprunedAttributes(t *testing.T) {
+	policy, err := createPolicy("2 OF (A, B, (C AND SA))")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A and B make up the gate, SA on its own satisfies none of its children
+	if err := policy.getCoefficients(nil, nil, []string{"A", "B", "SA"}); err == nil {
+		t.Fatal("expected an error for SA, which takes no part in the reconstruction")
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// AND binds tighter than OR, chains of the same operator become one n-ary gate, and the normalised form parses back to itself
+func TestParsePrecedence(t *testing.T) {
+	tests := []struct {
+		policy     string
+		normalized string
+		root       string
+		children   int
+	}{
+		{"A OR B AND C", "A OR (B AND C)", "OR", 2},
+		{"A AND B OR C", "(A AND B) OR C", "OR", 2},
+		{"A AND B AND C", "A AND B AND C", "AND", 3},
+		{"A OR B OR C AND D", "A OR B OR (C AND D)", "OR", 3},
+		{"(A OR B) AND C", "(A OR B) AND C", "AND", 2},
+		{"a and (b or c[hospital])", "A AND (B OR C[HOSPITAL])", "AND", 2},
+		{"2 OF (A, B OR C, D AND E)", "2 OF (A, B OR C, D AND E)", "OF", 3},
+		{"1 OF (A, B) AND C", "1 OF (A, B) AND C", "AND", 2},
+		{"((A))", "A", "A", 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			policy, err := createPolicy(test.policy)
+			if err != nil {
+				t.Fatalf("createPolicy(%q): %v", test.policy, err)
+			}
+
+			if policy.val != test.root || len(policy.children) != test.children {
+				t.Errorf("root is %s with %d children, want %s with %d", policy.val, len(policy.children), test.root, test.children)
+			}
+
+			normalized := policy.String()
+			if normalized != test.normalized {
+				t.Fatalf("String() = %q, want %q", normalized, test.normalized)
+			}
+
+			reparsed, err := createPolicy(normalized)
+			if err != nil {
+				t.Fatalf("createPolicy(%q): %v", normalized, err)
+			}
+			if reparsed.String() != normalized {
+				t.Errorf("String() of the normalised policy = %q, want %q", reparsed.String(), normalized)
+			}
+		})
+	}
+}
+
+// Malformed policies are rejected with the position of the offending token
+func TestParseSyntaxErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		position int
+		found    string
+	}{
+		{"empty policy", "", 0, ""},
+		{"unclosed parenthesis", "(A AND B", 4, ""},
+		{"unopened parenthesis", "A AND B)", 3, ")"},
+		{"dangling operator", "A AND", 2, ""},
+		{"leading operator", "OR A", 0, "OR"},
+		{"zero threshold", "0 OF (A, B)", 1, "OF"},
+		{"threshold above the children", "3 OF (A, B)", 0, "3"},
+		{"threshold without parentheses", "1 OF A", 2, "A"},
+		{"empty sub-policy", "A AND ()", 3, ")"},
+		{"empty threshold child", "2 OF (A, , B)", 5, ","},
+		{"attribute without a name", "A AND [HOSPITAL]", 2, "[HOSPITAL]"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := createPolicy(test.policy)
+			if err == nil {
+				t.Fatalf("createPolicy(%q) succeeded", test.policy)
+			}
+
+			syntaxErr, ok := err.(*policySyntaxError)
+			if !ok {
+				t.Fatalf("createPolicy(%q) returned %T, want *policySyntaxError", test.policy, err)
+			}
+			if syntaxErr.Position != test.position || syntaxErr.Found != test.found {
+				t.Errorf("error at token %d (found %q), want token %d (found %q): %v", syntaxErr.Position, syntaxErr.Found, test.position, test.found, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package abe
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func pathPolicy(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "policy/parse",
+
+			Fields: map[string]*framework.FieldSchema{
+				"policy": {
+					Type:        framework.TypeString,
+					Description: "The access policy to inspect (e.g. `2 OF (DOCTOR[HOSPITAL], NURSE[HOSPITAL], AUDITOR)`)",
+					Required:    true,
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback:    b.parsePolicy,
+					Summary:     "Parse a policy and return its syntax tree and attributes.",
+					Description: "The policy is also checked as encrypt checks it: `encryptable` tells whether a plaintext can be encrypted under it.",
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback:    b.parsePolicy,
+					Summary:     "Parse a policy and return its syntax tree and attributes.",
+					Description: "The policy is also checked as encrypt checks it: `encryptable` tells whether a plaintext can be encrypted under it.",
+				},
+			},
+		},
+		{
+			Pattern: "policy/satisfy/" + framework.GenericNameRegex("entity_id"),
+
+			Fields: map[string]*framework.FieldSchema{
+				"entity_id": {
+					Type:        framework.TypeString,
+					Description: "[Required] The GID whose keys are checked against the policy",
+				},
+				"policy": {
+					Type:        framework.TypeString,
+					Description: "The policy to check (either `policy` or `cryptogram` must be given)",
+				},
+				"cryptogram": {
+					Type:        framework.TypeString,
+					Description: "A cryptogram whose embedded policy is checked (either `policy` or `cryptogram` must be given)",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback:    b.satisfyPolicy,
+					Summary:     "Check whether the keys of a GID satisfy a policy, without decrypting anything.",
+					Description: "For a cryptogram, only the keys of the versions it was encrypted with, that may still decrypt, count.",
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback:    b.satisfyPolicy,
+					Summary:     "Check whether the keys of a GID satisfy a policy, without decrypting anything.",
+					Description: "For a cryptogram, only the keys of the versions it was encrypted with, that may still decrypt, count.",
+				},
+			},
+		},
+	}
+}
+
+func (b *backend) parsePolicy(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	policy_str := data.Get("policy").(string)
+
+	policy, err := createPolicy(policy_str)
+	if err != nil {
+		resp := logical.ErrorResponse(fmt.Sprintf("Invalid policy: %s", err))
+		if syntaxErr, ok := err.(*policySyntaxError); ok {
+			resp.Data["syntax_error"] = syntaxErr
+		}
+		return resp, nil
+	}
+
+	attributesList, err := b.allAttributesPutTogether(ctx, req)
+	if err != nil {
+		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+	}
+
+	unknownAttributes := []string{}
+	for _, attribute := range policy.uniqueAttributes() {
+		if _, exists := attributesList[strings.ToUpper(attribute)]; !exists {
+			unknownAttributes = append(unknownAttributes, attribute)
+		}
+	}
+
+	response := map[string]interface{}{
+		"normalized_policy":  policy.String(),
+		"ast":                policy.toAST(),
+		"attributes":         policy.getAttributeList(),
+		"unknown_attributes": unknownAttributes,
+	}
+
+	// The policy is checked as encrypt would check it, so that both agree on whether it can be used
+	encryptionResp, err := b.checkEncryptionPolicy(ctx, policy, attributesList)
+	if err != nil {
+		return nil, err
+	}
+
+	response["encryptable"] = encryptionResp == nil
+	if encryptionResp != nil {
+		if encryptionResp.IsError() {
+			response["encryption_error"] = encryptionResp.Data["error"]
+		} else {
+			response["attributes_availability"] = encryptionResp.Data["attributes_availability"]
+		}
+	}
+
+	return &logical.Response{
+		Data: response,
+	}, nil
+}
+
+func (b *backend) satisfyPolicy(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	GID := data.Get("entity_id").(string)
+	policy_str := data.Get("policy").(string)
+	encryptedMessage := data.Get("cryptogram").(string)
+
+	if (policy_str == "") == (encryptedMessage == "") {
+		return logical.ErrorResponse("Provide either a policy or a cryptogram"), nil
+	}
+
+	var cts *cryptogram
+	if encryptedMessage != "" {
+		decoded, err := b.decodeCryptogram(encryptedMessage)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid cryptogram: %s", err)), nil
+		}
+		cts = &decoded
+		policy_str = cts.PolicyStr
+	}
+
+	policy, err := createPolicy(policy_str)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Invalid policy: %s", err)), nil
+	}
+
+	GIDData, err := b.loadGIDData(ctx, req, GID)
+	if err != nil {
+		return nil, errwrap.Wrapf("Error with GID data: {{err}}", err)
+	}
+
+	if GIDData.GID == "" {
+		return logical.ErrorResponse(fmt.Sprintf("No keys have been generated for the GID %s", GID)), nil
+	}
+
+	heldAttributes := b.gidAttributeList(GIDData)
+
+	// Only the keys of the versions a cryptogram was encrypted with, that may still decrypt, are of use
+	unusableAttributes := []string{}
+	if cts != nil {
+		heldAttributes, unusableAttributes, err = b.cryptogramAttributes(ctx, GIDData, heldAttributes, policy, cts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	policySatisfied, pruned := policy.prune(heldAttributes)
+
+	response := map[string]interface{}{
+		"entity_id":         GID,
+		"normalized_policy": policy.String(),
+		"satisfied":         policySatisfied,
+	}
+
+	if cts != nil {
+		response["unusable_attributes"] = unusableAttributes
+	}
+
+	if policySatisfied {
+		response["satisfying_attributes"] = pruned
+	} else {
+		response["missing_attributes"] = policy.missingAttributes(heldAttributes)
+	}
+
+	return &logical.Response{
+		Data: response,
+	}, nil
+}
+
+// cryptogramAttributes splits the attributes of a GID that are part of the policy of a cryptogram between the ones whose keys
+// can decrypt it and the ones whose version of the keys is not held, no longer kept or below its min_decryption_version
+func (b *backend) cryptogramAttributes(ctx context.Context, GIDData gidData, heldAttributes []string, policy node, cts *cryptogram) ([]string, []string, error) {
+	policyAttributes := policy.uniqueAttributes()
+
+	usable, unusable := []string{}, []string{}
+
+	for _, attribute := range heldAttributes {
+		if !searchSlice(policyAttributes, attribute) {
+			continue
+		}
+
+		// The keys of the system attributes are constructed from the version the cryptogram was encrypted with
+		if sliceContains(GIDData.SYSTEM_ATTRIBUTES, attribute) {
+			version := cts.keyVersion(attribute)
+
+			config, err := b.getKeyConfig(ctx, attribute)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			keys, err := b.loadAttributeKeys(ctx, SystemAttributes, attribute, version)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if version < config.MinDecryptionVersion || keys == nil {
+				unusable = append(unusable, attribute)
+			} else {
+				usable = append(usable, attribute)
+			}
+			continue
+		}
+
+		entry, attributeName := CommonAttributes, attribute
+		if strings.Contains(attribute, "[") {
+			authority, trimmedAttribute, err := b.separateAuthorityFromAttribute(attribute)
+			if err != nil {
+				return nil, nil, errwrap.Wrapf("Internal error: {{err}}", err)
+			}
+			entry, attributeName = authority, trimmedAttribute
+		}
+
+		key, err := b.cryptogramKey(ctx, GIDData, attribute, GIDData.attributeKeys(entry)[attributeName], cts)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if key == nil {
+			unusable = append(unusable, attribute)
+		} else {
+			usable = append(usable, attribute)
+		}
+	}
+
+	return usable, unusable, nil
+}
@@ -0,0 +1,130 @@
+package abe
+
+import (
+	"bytes"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Nik-U/pbc"
+)
+
+const (
+	precomputedGeneratorCache    = "precomputedGenerator"
+	precomputedAttributeCache    = "precomputedAttribute/"
+	precomputedAttributeLifetime = time.Hour
+)
+
+// generatorTables holds e(g,h) and the fixed-base tables of g, h and e(g,h), which every encryption and key generation
+// exponentiate. h is the generator of G2, the same as g for symmetric pairings.
+type generatorTables struct {
+	generator   *pbc.Element
+	g2Generator *pbc.Element
+	egg         *pbc.Element
+	eggPower    *pbc.Power
+	gPower      *pbc.Power
+	hPower      *pbc.Power
+}
+
+// attributeTables holds the fixed-base tables of the published e(g,h)^alpha_i and h^y_i of an attribute.
+// The published keys they were built from are kept, so that tables of replaced keys are never used.
+type attributeTables struct {
+	published     keysData
+	eggAlphaPower *pbc.Power
+	gYPower       *pbc.Power
+}
+
+type precomputeStats struct {
+	generatorHits          uint64
+	generatorMisses        uint64
+	attributeHits          uint64
+	attributeMisses        uint64
+	attributeInvalidations uint64
+}
+
+// getGeneratorTables returns the tables of the current generator, building them on first use
+func (b *backend) getGeneratorTables() *generatorTables {
+	ecElement := b.getABEElement()
+	g2Element := b.getABEG2Element()
+
+	if cached, exists := b.abeCache.Get(precomputedGeneratorCache); exists {
+		if tables := cached.(*generatorTables); tables.generator == ecElement && tables.g2Generator == g2Element {
+			atomic.AddUint64(&b.precomputeStats.generatorHits, 1)
+			return tables
+		}
+	}
+	atomic.AddUint64(&b.precomputeStats.generatorMisses, 1)
+
+	egg := ecElement.Pairing().NewGT().Pair(ecElement, g2Element)
+
+	tables := &generatorTables{
+		generator:   ecElement,
+		g2Generator: g2Element,
+		egg:         egg,
+		eggPower:    egg.PreparePower(),
+		gPower:      ecElement.PreparePower(),
+		hPower:      g2Element.PreparePower(),
+	}
+
+	b.abeCache.SetDefault(precomputedGeneratorCache, tables)
+
+	return tables
+}
+
+// getAttributeTables returns the tables of an attribute (in the form it takes in a policy) for its published keys.
+// Tables that are not used for a while are dropped, to bound the memory of mounts with many attributes.
+func (b *backend) getAttributeTables(attribute string, published keysData) *attributeTables {
+	if cached, exists := b.abeCache.Get(precomputedAttributeCache + attribute); exists {
+		tables := cached.(*attributeTables)
+		if bytes.Equal(tables.published.Alphai, published.Alphai) && bytes.Equal(tables.published.Yi, published.Yi) {
+			atomic.AddUint64(&b.precomputeStats.attributeHits, 1)
+			return tables
+		}
+		atomic.AddUint64(&b.precomputeStats.attributeInvalidations, 1)
+	}
+	atomic.AddUint64(&b.precomputeStats.attributeMisses, 1)
+
+	ecElement := b.getABEElement()
+
+	tables := &attributeTables{
+		published:     published,
+		eggAlphaPower: ecElement.Pairing().NewGT().SetBytes(published.Alphai).PreparePower(),
+		gYPower:       ecElement.Pairing().NewG2().SetBytes(published.Yi).PreparePower(),
+	}
+
+	b.abeCache.Set(precomputedAttributeCache+attribute, tables, precomputedAttributeLifetime)
+
+	return tables
+}
+
+// invalidateGeneratorTables drops the tables of the generator, e.g. when the global parameters are (re)loaded
+func (b *backend) invalidateGeneratorTables() {
+	b.abeCache.Delete(precomputedGeneratorCache)
+}
+
+// invalidateAttributeTables drops the tables of an attribute whose keys have been replaced
+func (b *backend) invalidateAttributeTables(attribute string) {
+	if _, exists := b.abeCache.Get(precomputedAttributeCache + attribute); exists {
+		atomic.AddUint64(&b.precomputeStats.attributeInvalidations, 1)
+		b.abeCache.Delete(precomputedAttributeCache + attribute)
+	}
+}
+
+// precomputeMetrics returns the counters of the precomputed tables
+func (b *backend) precomputeMetrics() map[string]interface{} {
+	cachedAttributes := 0
+	for key := range b.abeCache.Items() {
+		if strings.HasPrefix(key, precomputedAttributeCache) {
+			cachedAttributes++
+		}
+	}
+
+	return map[string]interface{}{
+		"generator_hits":          atomic.LoadUint64(&b.precomputeStats.generatorHits),
+		"generator_misses":        atomic.LoadUint64(&b.precomputeStats.generatorMisses),
+		"attribute_hits":          atomic.LoadUint64(&b.precomputeStats.attributeHits),
+		"attribute_misses":        atomic.LoadUint64(&b.precomputeStats.attributeMisses),
+		"attribute_invalidations": atomic.LoadUint64(&b.precomputeStats.attributeInvalidations),
+		"cached_attributes":       cachedAttributes,
+	}
+}
@@ -0,0 +1,238 @@
+package abe
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Nik-U/pbc"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const revokePath = "revoke"
+
+func pathRevoke(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: revokePath + "/" + framework.GenericNameRegex("authority") + "/" + framework.GenericNameRegex("attribute"),
+
+			Fields: map[string]*framework.FieldSchema{
+				"authority": {
+					Type:        framework.TypeString,
+					Description: fmt.Sprintf("[Required] The authority of the attribute, or `%s` for a common attribute", CommonAttributesEndpoint),
+				},
+				"attribute": {
+					Type:        framework.TypeString,
+					Description: "[Required] The attribute to revoke",
+				},
+				"gid": {
+					Type:        framework.TypeString,
+					Description: "[Required] The GID to revoke the attribute from",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback:    b.revokeAttribute,
+					Summary:     "Revoke an attribute from a GID.",
+					Description: "The keys of the attribute are rotated to a new version and issued again to every other GID that holds it. What happens to the previous version is configured at " + revocationConfigPath + ".",
+				},
+			},
+		},
+	}
+}
+
+// attributeKeys returns the keys of a GID for the attributes of an entry (an authority or CommonAttributes)
+func (data *gidData) attributeKeys(entry string) map[string][]byte {
+	if entry == CommonAttributes {
+		return data.COMMON_ATTRIBUTES
+	}
+
+	for authority, keys := range data.AUTHORITY_ATTRIBUTES {
+		if strings.EqualFold(authority, entry) {
+			return keys
+		}
+	}
+
+	return nil
+}
+
+func (b *backend) revokeAttribute(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	authority := data.Get("authority").(string)
+	attribute := strings.ToUpper(data.Get("attribute").(string))
+	GID := data.Get("gid").(string)
+
+	if GID == "" {
+		return logical.ErrorResponse("gid is required"), nil
+	}
+
+	entry := attributeEntry(authority)
+	policyAttribute := policyAttributeName(entry, attribute)
+
+	// The attribute lock keeps the holders of the attribute as they are; the records of the GIDs are locked one at a time,
+	// as two GIDs may share a lock
+	defer b.lockAttributes(policyAttribute)()
+
+	revokedData, err := b.loadGIDData(ctx, req, GID)
+	if err != nil {
+		return nil, errwrap.Wrapf("Error with GID data: {{err}}", err)
+	}
+
+	config, err := b.getRevocationConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keepPrevious := config.PreviousVersions == previousVersionsDecryptOnly
+
+	if revokedData.attributeKeys(entry)[attribute] == nil {
+		current, err := b.loadCurrentAttributeKeys(ctx, entry, attribute)
+		if err != nil {
+			return nil, err
+		}
+		if current == nil {
+			return logical.ErrorResponse(fmt.Sprintf("The attribute %s does not exist", policyAttribute)), nil
+		}
+
+		// The GID is only stripped once the other holders have the new version, so a revocation that was already recorded is complete
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"revoked_from":      GID,
+				"attribute":         policyAttribute,
+				"key_version":       current.Version,
+				"previous_versions": config.PreviousVersions,
+				"reissued_to":       []string{},
+			},
+			Warnings: []string{fmt.Sprintf("%s does not hold the attribute %s", GID, policyAttribute)},
+		}, nil
+	}
+
+	// The keys are rotated and issued again to the other holders first, and the GID is stripped of the attribute last,
+	// so that a revocation that fails half way can be carried out again
+	currentKeys, err := b.rotateAttributeKeys(ctx, entry, attribute, keepPrevious)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to rotate the attribute: {{err}}", err)
+	}
+
+	reissued, err := b.reissueAttributeKeys(ctx, req, entry, attribute, currentKeys, keepPrevious, GID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.stripAttribute(ctx, req, GID, entry, attribute); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"revoked_from":      GID,
+			"attribute":         policyAttribute,
+			"key_version":       currentKeys.Version,
+			"previous_versions": config.PreviousVersions,
+			"reissued_to":       reissued,
+		},
+	}, nil
+}
+
+// attributeEntry returns where the keys of the attributes of an authority are stored, `commonattributes` and
+// `systemattributes` standing for the common and the system attributes
+func attributeEntry(authority string) string {
+	switch strings.ToLower(authority) {
+	case CommonAttributesEndpoint:
+		return CommonAttributes
+	case SystemAttributesEndpoint:
+		return SystemAttributes
+	default:
+		return authority
+	}
+}
+
+// stripAttribute takes every version of the keys of an attribute away from a GID
+func (b *backend) stripAttribute(ctx context.Context, req *logical.Request, GID string, entry string, attribute string) error {
+	defer b.lockGID(GID)()
+
+	// The record is read again under the lock, for the keys of the other attributes issued in the meantime
+	revokedData, err := b.loadGIDData(ctx, req, GID)
+	if err != nil {
+		return errwrap.Wrapf("Error with GID data: {{err}}", err)
+	}
+
+	delete(revokedData.attributeKeys(entry), attribute)
+	revokedData.forgetAttribute(policyAttributeName(entry, attribute))
+
+	return b.dataStore(ctx, revokedData, genpath)
+}
+
+// reissueAttributeKeys gives the current version of the keys of an attribute to every GID that holds it, except the given one.
+// It returns the GIDs whose keys were issued again.
+func (b *backend) reissueAttributeKeys(ctx context.Context, req *logical.Request, entry string, attribute string, currentKeys *keysData, keepPrevious bool, except string) ([]string, error) {
+	gids, err := b.storage.List(ctx, genpath+keypathGids)
+	if err != nil {
+		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+	}
+
+	ecElement := b.getABEElement()
+	gidMapper := b.createHashMapper(ecElement)
+
+	reissued := []string{}
+
+	for _, holder := range gids {
+		if holder == except {
+			continue
+		}
+
+		holds, err := b.reissueHolderKeys(ctx, req, holder, entry, attribute, currentKeys, keepPrevious, gidMapper(holder))
+		if err != nil {
+			return nil, err
+		}
+
+		if holds {
+			reissued = append(reissued, holder)
+		}
+	}
+
+	sort.Strings(reissued)
+
+	return reissued, nil
+}
+
+// reissueHolderKeys gives the current version of the keys of an attribute to a GID, returning false if it does not hold the attribute
+func (b *backend) reissueHolderKeys(ctx context.Context, req *logical.Request, holder string, entry string, attribute string, currentKeys *keysData, keepPrevious bool, hashedGIDInEC *pbc.Element) (bool, error) {
+	policyAttribute := policyAttributeName(entry, attribute)
+
+	defer b.lockGID(holder)()
+
+	holderData, err := b.loadGIDData(ctx, req, holder)
+	if err != nil {
+		return false, errwrap.Wrapf("Error with GID data: {{err}}", err)
+	}
+
+	holderKeys := holderData.attributeKeys(entry)
+	if holderKeys[attribute] == nil {
+		return false, nil
+	}
+
+	var previousKeys map[int][]byte
+	if keepPrevious {
+		previousKeys = make(map[int][]byte)
+		for version, key := range holderData.PREVIOUS_KEYS[policyAttribute] {
+			previousKeys[version] = key
+		}
+		previousKeys[holderData.attributeVersion(policyAttribute)] = holderKeys[attribute]
+	}
+
+	holderKeys[attribute] = b.userAttributeKey(hashedGIDInEC, *currentKeys)
+	holderData.setAttributeVersion(policyAttribute, currentKeys.Version, previousKeys)
+
+	if holderData.GID == "" {
+		holderData.GID = holder
+	}
+
+	if err := b.dataStore(ctx, holderData, genpath); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
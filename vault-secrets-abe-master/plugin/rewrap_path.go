@@ -0,0 +1,291 @@
+package abe
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Nik-U/pbc"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// rewrapGID is the identity the keys of a rewrap are constructed for; the shares of w sum to zero, so any identity recovers the session element
+const rewrapGID = "rewrap"
+
+func pathRewrap(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "rewrap",
+
+			Fields: map[string]*framework.FieldSchema{
+				"cryptogram": {
+					Type:        framework.TypeString,
+					Description: "[Required] The cryptogram to encrypt again",
+				},
+				"policy": {
+					Type:        framework.TypeString,
+					Description: "The policy of the new cryptogram; defaults to the policy of the given cryptogram. Another policy is only accepted when " + rewrapConfigPath + " allows it.",
+				},
+				"cipher": {
+					Type:        framework.TypeString,
+					Description: fmt.Sprintf("The AEAD of the new cryptogram (`%s` or `%s`); defaults to the AEAD of the given cryptogram, or %s for the cryptograms that predate the AEADs", cipherAES256GCM, cipherChaCha20Poly1305, defaultCipher),
+				},
+				"format": {
+					Type:        framework.TypeString,
+					Description: "The encoding of the new cryptogram (`json` or `binary`); defaults to the encoding of the given cryptogram",
+				},
+				"batch_input": {
+					Type:        framework.TypeSlice,
+					Description: batchInputDescription,
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback:    b.rewrap,
+					Summary:     "Encrypt a cryptogram again, under the same or a new policy, with the latest versions of the keys of its attributes.",
+					Description: "The plaintext is never returned. The versions of the keys the cryptogram was encrypted with must still be kept and be allowed to decrypt. A new policy is checked as encrypt checks it.",
+				},
+			},
+		},
+	}
+}
+
+func (b *backend) rewrap(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Info("Invoked: Rewrap")
+
+	attributesList, err := b.allAttributesPutTogether(ctx, req)
+	if err != nil {
+		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+	}
+
+	config, err := b.getPerformanceConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	registeredAuthorities, err := b.registeredAuthorities(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rewrapSettings, err := b.getRewrapConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	hashedGIDInEC := b.createHashMapper(b.getABEElement())(rewrapGID)
+
+	// The keys are constructed at most once per request, attribute and key version, whatever the number of cryptograms
+	rewrapKeys := make(map[string][]byte)
+
+	request := map[string]string{
+		"cryptogram": data.Get("cryptogram").(string),
+		"policy":     data.Get("policy").(string),
+		"cipher":     data.Get("cipher").(string),
+		"format":     data.Get("format").(string),
+	}
+
+	rawBatchInput, hasBatchInput := data.GetOk("batch_input")
+	if !hasBatchInput {
+		itemData, resp, err := b.rewrapItem(ctx, request, attributesList, registeredAuthorities, hashedGIDInEC, rewrapKeys, rewrapSettings, config.Workers)
+		if err != nil || resp != nil {
+			return resp, err
+		}
+
+		return &logical.Response{
+			Data: itemData,
+		}, nil
+	}
+
+	batchInput, err := parseBatchInput(rawBatchInput)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	batchResults := make([]map[string]interface{}, 0, len(batchInput))
+
+	for _, item := range batchInput {
+		for _, field := range []string{"policy", "cipher", "format"} {
+			item[field] = batchItemValue(item, field, request[field])
+		}
+
+		itemData, resp, err := b.rewrapItem(ctx, item, attributesList, registeredAuthorities, hashedGIDInEC, rewrapKeys, rewrapSettings, config.Workers)
+		batchResults = append(batchResults, batchItemResult(itemData, resp, err))
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"batch_results": batchResults,
+		},
+	}, nil
+}
+
+// rewrapItem encrypts a single cryptogram again, returning the response data or a response explaining why it could not be rewrapped
+func (b *backend) rewrapItem(ctx context.Context, item map[string]string, attributesList map[string]keysData, registeredAuthorities []string, hashedGIDInEC *pbc.Element, rewrapKeys map[string][]byte, settings rewrapConfig, workers int) (map[string]interface{}, *logical.Response, error) {
+	cts, err := b.decodeCryptogram(item["cryptogram"])
+	if err != nil {
+		return nil, logical.ErrorResponse(fmt.Sprintf("Invalid cryptogram: %s", err)), nil
+	}
+
+	// The data key a cryptogram wraps is derived from its session element, which a new cryptogram does not share
+	if cts.cipherType() == cipherNone {
+		return nil, logical.ErrorResponse("The cryptogram only wraps a data key, which can not be rewrapped; generate a new data key instead"), nil
+	}
+
+	policy, err := createPolicy(cts.PolicyStr)
+	if err != nil {
+		return nil, logical.ErrorResponse(fmt.Sprintf("Invalid cryptogram policy: %s", err)), nil
+	}
+
+	newPolicy, newPolicyStr := policy, cts.PolicyStr
+	if item["policy"] != "" && item["policy"] != cts.PolicyStr {
+		// Changing the policy hands the plaintext over to other holders, which only the mount configuration may allow
+		if !settings.AllowPolicyChange {
+			return nil, logical.ErrorResponse("Rewrapping under a new policy is disabled, see " + rewrapConfigPath), nil
+		}
+
+		newPolicyStr = item["policy"]
+		if newPolicy, err = createPolicy(newPolicyStr); err != nil {
+			return nil, logical.ErrorResponse(fmt.Sprintf("Invalid policy: %s", err)), nil
+		}
+
+		// The new policy is refused before anything is decrypted
+		if resp, err := b.checkEncryptionPolicy(ctx, newPolicy, attributesList); err != nil || resp != nil {
+			return nil, resp, err
+		}
+	}
+
+	cipherType := strings.ToLower(item["cipher"])
+	if cipherType == "" {
+		cipherType = cts.cipherType()
+		if !isSupportedCipher(cipherType) {
+			cipherType = defaultCipher
+		}
+	}
+	if !isSupportedCipher(cipherType) {
+		return nil, logical.ErrorResponse(fmt.Sprintf("Unsupported cipher %s (supported: %s, %s)", cipherType, cipherAES256GCM, cipherChaCha20Poly1305)), nil
+	}
+
+	format := strings.ToLower(item["format"])
+	if format == "" {
+		format = cts.format
+	}
+	if format != cryptogramFormatJSON && format != cryptogramFormatBinary {
+		return nil, logical.ErrorResponse(fmt.Sprintf("Unsupported format %s (supported: %s, %s)", format, cryptogramFormatJSON, cryptogramFormatBinary)), nil
+	}
+
+	rewrapData, err := b.rewrapGIDData(ctx, policy, &cts, registeredAuthorities, hashedGIDInEC, rewrapKeys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The keys of the system attributes are part of the rewrap keys, a partial system decryption would count them twice
+	cts.SysDecrypted, cts.SysDecryptedAttr = nil, nil
+
+	randomKey, resp, err := b.decapsulate(ctx, rewrapGID, rewrapData, policy, policy, &cts, workers)
+	if err != nil || resp != nil {
+		return nil, resp, err
+	}
+
+	plaintext, err := openPayload(cts.cipherType(), randomKey, cts.CipherIV, cts.EncryptedMessage, cts.associatedData())
+	if err != nil {
+		return nil, logical.ErrorResponse(fmt.Sprintf("Decryption error: %s", err)), nil
+	}
+
+	generatedData, newRandomKey, resp, err := b.encapsulate(ctx, newPolicy, newPolicyStr, cipherType, attributesList, workers)
+	if err != nil || resp != nil {
+		return nil, resp, err
+	}
+	generatedData.format = format
+
+	generatedData.EncryptedMessage, generatedData.CipherIV, err = sealPayload(cipherType, newRandomKey, plaintext, generatedData.associatedData())
+	if err != nil {
+		return nil, nil, errwrap.Wrapf("error in encryption: {{err}}", err)
+	}
+
+	b64Encoded, err := b.encodeCryptogram(*generatedData)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return map[string]interface{}{
+		"b64_enc_data": b64Encoded,
+		"key_versions": generatedData.Header.KeyVersions,
+	}, nil, nil
+}
+
+// rewrapGIDData constructs, from the private keys of the attributes, the keys of the versions a cryptogram was encrypted with.
+// The attributes whose version is no longer kept or may no longer decrypt are left out.
+func (b *backend) rewrapGIDData(ctx context.Context, policy node, cts *cryptogram, registeredAuthorities []string, hashedGIDInEC *pbc.Element, rewrapKeys map[string][]byte) (gidData, error) {
+	data := gidData{
+		GID:                  rewrapGID,
+		COMMON_ATTRIBUTES:    make(map[string][]byte),
+		AUTHORITY_ATTRIBUTES: make(map[string]map[string][]byte),
+		KEY_VERSIONS:         make(map[string]int),
+	}
+
+	for _, attribute := range policy.uniqueAttributes() {
+		version := cts.keyVersion(attribute)
+
+		config, err := b.getKeyConfig(ctx, attribute)
+		if err != nil {
+			return data, err
+		}
+		if version < config.MinDecryptionVersion {
+			continue
+		}
+
+		entry, attributeName := CommonAttributes, attribute
+		if strings.Contains(attribute, "[") {
+			authority, trimmedAttribute, err := b.separateAuthorityFromAttribute(attribute)
+			if err != nil {
+				return data, errwrap.Wrapf("Internal error: {{err}}", err)
+			}
+
+			entry, attributeName = "", trimmedAttribute
+			for _, registeredAuthority := range registeredAuthorities {
+				if strings.EqualFold(registeredAuthority, authority) {
+					entry = registeredAuthority
+					break
+				}
+			}
+			if entry == "" {
+				continue
+			}
+		}
+
+		memoKey := fmt.Sprintf("%s/%s/%d", entry, attributeName, version)
+		if rewrapKeys[memoKey] == nil {
+			private, err := b.loadAttributeKeys(ctx, entry, strings.ToUpper(attributeName), version)
+			if err != nil {
+				return data, err
+			}
+			// Common and system attributes share the same names in the policies
+			if private == nil && entry == CommonAttributes {
+				private, err = b.loadAttributeKeys(ctx, SystemAttributes, strings.ToUpper(attributeName), version)
+				if err != nil {
+					return data, err
+				}
+			}
+			if private == nil {
+				continue
+			}
+			rewrapKeys[memoKey] = b.userAttributeKey(hashedGIDInEC, *private)
+		}
+
+		if entry == CommonAttributes {
+			data.COMMON_ATTRIBUTES[attribute] = rewrapKeys[memoKey]
+		} else {
+			if data.AUTHORITY_ATTRIBUTES[entry] == nil {
+				data.AUTHORITY_ATTRIBUTES[entry] = make(map[string][]byte)
+			}
+			data.AUTHORITY_ATTRIBUTES[entry][attributeName] = rewrapKeys[memoKey]
+		}
+		data.KEY_VERSIONS[strings.ToUpper(attribute)] = version
+	}
+
+	return data, nil
+}
@@ -0,0 +1,185 @@
+package abe
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/Nik-U/pbc"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// Legacy cryptograms have no cipher recorded and use AES-256-CBC with PKCS#7 padding, without any integrity check
+	cipherAES256CBC = "aes256-cbc"
+
+	cipherAES256GCM        = "aes256-gcm96"
+	cipherChaCha20Poly1305 = "chacha20-poly1305"
+
+	// cipherNone marks the cryptograms that only wrap a data key (see `datakey`) and carry no payload
+	cipherNone = "none"
+
+	defaultCipher = cipherAES256GCM
+
+	symmetricKeySize = 32
+	kdfSaltSize      = 32
+
+	// kdfInfo separates the keys derived for the payload from any other use of the GT element
+	kdfInfo = "vault-secrets-abe payload key v2"
+)
+
+var errPayloadAuthentication = errors.New("the cryptogram could not be authenticated")
+
+// deriveSymmetricKey turns the GT session element into the key of the payload
+func deriveSymmetricKey(kdf string, element *pbc.Element, salt []byte) ([]byte, error) {
+	switch kdf {
+	case kdfLegacySHA256:
+		key := sha256.Sum256([]byte(element.String()))
+		return key[:], nil
+	case kdfHKDFSHA256:
+		key := make([]byte, symmetricKeySize)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, element.Bytes(), salt, []byte(kdfInfo)), key); err != nil {
+			return nil, err
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key derivation function %q", kdf)
+	}
+}
+
+func isSupportedCipher(cipherType string) bool {
+	return cipherType == cipherAES256GCM || cipherType == cipherChaCha20Poly1305
+}
+
+func newAEAD(cipherType string, key []byte) (cipher.AEAD, error) {
+	switch cipherType {
+	case cipherAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case cipherChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	default:
+		return nil, fmt.Errorf("unsupported cipher %q", cipherType)
+	}
+}
+
+// sealPayload encrypts the plaintext with the given AEAD, binding the additional data to the ciphertext
+func sealPayload(cipherType string, key []byte, plaintext []byte, additionalData []byte) ([]byte, []byte, error) {
+	aead, err := newAEAD(cipherType, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+
+	return aead.Seal(nil, nonce, plaintext, additionalData), nonce, nil
+}
+
+// openPayload decrypts a payload produced by sealPayload, or a legacy AES-CBC payload
+func openPayload(cipherType string, key []byte, nonce []byte, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	if cipherType == cipherAES256CBC {
+		return openLegacyPayload(key, nonce, ciphertext)
+	}
+
+	aead, err := newAEAD(cipherType, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nonce) != aead.NonceSize() {
+		return nil, errPayloadAuthentication
+	}
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, errPayloadAuthentication
+	}
+
+	return plaintext, nil
+}
+
+func openLegacyPayload(key []byte, iv []byte, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(iv) != block.BlockSize() || len(ciphertext) == 0 || len(ciphertext)%block.BlockSize() != 0 {
+		return nil, errPayloadAuthentication
+	}
+
+	secretMsgPadded := make([]byte, len(ciphertext))
+	decrypter := cipher.NewCBCDecrypter(block, iv)
+	decrypter.CryptBlocks(secretMsgPadded, ciphertext)
+
+	paddingLength := int(secretMsgPadded[len(secretMsgPadded)-1])
+	if paddingLength == 0 || paddingLength > block.BlockSize() {
+		return nil, errPayloadAuthentication
+	}
+
+	return secretMsgPadded[:len(secretMsgPadded)-paddingLength], nil
+}
+
+// associatedData serializes the header, the policy and the ABE components of the cryptogram, so that the AEAD
+// authenticates them together with the message. SysDecrypted and SysDecryptedAttr are left out on purpose, as they are only
+// added after the encryption by `sysdecrypt`.
+func (cts *cryptogram) associatedData() []byte {
+	var buf bytes.Buffer
+
+	writeField := func(field []byte) {
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(field)))
+		buf.Write(length[:])
+		buf.Write(field)
+	}
+
+	if cts.Header != nil {
+		writeField([]byte(fmt.Sprintf("v%d", cts.Header.Version)))
+		writeField([]byte(cts.Header.Cipher))
+		writeField([]byte(cts.Header.KDF))
+		writeField(cts.Header.KDFSalt)
+		writeField(cts.Header.ParamsHash)
+
+		keyVersions := make([]string, 0, len(cts.Header.KeyVersions))
+		for attribute := range cts.Header.KeyVersions {
+			keyVersions = append(keyVersions, attribute)
+		}
+		sort.Strings(keyVersions)
+
+		for _, attribute := range keyVersions {
+			writeField([]byte(fmt.Sprintf("%s:%d", attribute, cts.Header.KeyVersions[attribute])))
+		}
+	}
+
+	writeField([]byte(cts.PolicyStr))
+	writeField(cts.C0)
+
+	attributes := make([]string, 0, len(cts.C1))
+	for attribute := range cts.C1 {
+		attributes = append(attributes, attribute)
+	}
+	sort.Strings(attributes)
+
+	for _, attribute := range attributes {
+		writeField([]byte(attribute))
+		writeField(cts.C1[attribute])
+		writeField(cts.C2[attribute])
+		writeField(cts.C3[attribute])
+	}
+
+	return buf.Bytes()
+}
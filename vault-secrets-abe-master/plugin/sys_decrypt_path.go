@@ -2,9 +2,8 @@ package abe
 
 import (
 	"context"
-	b64 "encoding/base64"
-	"encoding/json"
-	"math/big"
+	"fmt"
+	"strings"
 
 	"github.com/Nik-U/pbc"
 	"github.com/hashicorp/errwrap"
@@ -33,7 +32,14 @@ func pathSysDecrypt(b *backend) []*framework.Path {
 				"cryptogram": {
 					Type:        framework.TypeString,
 					Description: "[Required] Receives the attributes with which an Authority can create their keys",
-					Required:    true,
+				},
+				"format": {
+					Type:        framework.TypeString,
+					Description: "The encoding of the returned cryptogram (`json` or `binary`); defaults to the encoding of the given cryptogram",
+				},
+				"batch_input": {
+					Type:        framework.TypeSlice,
+					Description: batchInputDescription,
 				},
 			},
 
@@ -65,38 +71,82 @@ func (b *backend) sysDecrypt(ctx context.Context, req *logical.Request, data *fr
 	GID := data.Get("entity_id").(string)
 	subject := data.Get("subject").(string)
 	sub_policy_str := data.Get("sub_policy").(string)
+	format := data.Get("format").(string)
+
+	systemAttributeEntries, err := b.getEntries(ctx, []string{AuthoritiesPath, SystemAttributes})
+	if err != nil {
+		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+	}
+
+	ecElement := b.getABEElement()
+
+	gidData, err := b.loadGIDData(ctx, req, GID)
+	if err != nil {
+		return nil, errwrap.Wrapf("Error with GID data: {{err}}", err)
+	}
+
+	gidMapper := b.createHashMapper(ecElement)
+	hashedGIDInEC := gidMapper(subject)
+
+	// The keys of the system attributes are constructed at most once per request and key version, whatever the number of cryptograms
+	systemAttributeKeys := make(map[string][]byte)
+
+	rawBatchInput, hasBatchInput := data.GetOk("batch_input")
+	if !hasBatchInput {
+		itemData, resp, err := b.sysDecryptItem(ctx, req, gidData, systemAttributeEntries, hashedGIDInEC, systemAttributeKeys, sub_policy_str, data.Get("cryptogram").(string), format)
+		if err != nil || resp != nil {
+			return resp, err
+		}
 
+		return &logical.Response{
+			Data: itemData,
+		}, nil
+	}
+
+	batchInput, err := parseBatchInput(rawBatchInput)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	batchResults := make([]map[string]interface{}, 0, len(batchInput))
+
+	for _, item := range batchInput {
+		itemData, resp, err := b.sysDecryptItem(ctx, req, gidData, systemAttributeEntries, hashedGIDInEC, systemAttributeKeys, batchItemValue(item, "sub_policy", sub_policy_str), item["cryptogram"], batchItemValue(item, "format", format))
+		batchResults = append(batchResults, batchItemResult(itemData, resp, err))
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"batch_results": batchResults,
+		},
+	}, nil
+}
+
+// sysDecryptItem partially decrypts a single cryptogram, returning the response data or a response explaining why it could not be decrypted
+func (b *backend) sysDecryptItem(ctx context.Context, req *logical.Request, gidData gidData, systemAttributeEntries []string, hashedGIDInEC *pbc.Element, systemAttributeKeys map[string][]byte, sub_policy_str string, dataFromEncryption string, format string) (map[string]interface{}, *logical.Response, error) {
 	//First, we should check if the attribute is a SYSTEM Attribute or a common/authority attribute; If it is a SYSTEM Attribute, then we need to aggregate the ABE Keys of an authority, else of a user.
 	//If the policy has both (a SYSTEM Attribute AND a COMMON/AUTHORITY Attribute), then we must interrupt the process.
-	sub_policy := createPolicy(sub_policy_str)
+	sub_policy, err := createPolicy(sub_policy_str)
+	if err != nil {
+		return nil, logical.ErrorResponse(fmt.Sprintf("Invalid sub_policy: %s", err)), nil
+	}
 	policyAttrs := sub_policy.getAttributeList()
 
-	dataFromEncryption := data.Get("cryptogram").(string)
-	b64DecodedDataFromEncryption, base64ErrDataFromEncryption := b64.StdEncoding.DecodeString(dataFromEncryption)
-	if base64ErrDataFromEncryption != nil {
-		return nil, base64ErrDataFromEncryption
-	}
-	var cts cryptogram
-	err := json.Unmarshal(b64DecodedDataFromEncryption, &cts)
+	cts, err := b.decodeCryptogram(dataFromEncryption)
 	if err != nil {
-		return nil, err
+		return nil, logical.ErrorResponse(fmt.Sprintf("Invalid cryptogram: %s", err)), nil
 	}
 
-	systemAttributeEntries, err := b.getEntries(ctx, []string{AuthoritiesPath, SystemAttributes})
-	if err != nil {
-		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+	if _, err := createPolicy(cts.PolicyStr); err != nil {
+		return nil, logical.ErrorResponse(fmt.Sprintf("Invalid cryptogram policy: %s", err)), nil
 	}
+
 	_, nonExistentAttrsExist := b.checkNonExistentAttr(systemAttributeEntries, policyAttrs)
 	// If nonExistentAttrsExist == true, it means that the given attributes are NOT SYSTEM Attributes or that the given attributes include both SYSTEM AND COMMON/AUTHORITY Attributes
 	// We will continue as if the given attributes are only COMMON/AUTHORITY Attributes and try to (partially) decrypt the message with both the COMMON AND the AUTHORITY Attributes
 	// BUT, if nonExistentAttrsExist == false, that means that the given attributes are ONLY SYSTEM ATTRIBUTES!
-	
-	ecElement := b.getABEElement()
-
-	gidData, _ := b.loadGIDData(ctx, req, GID)
 
-	gidMapper := b.createHashMapper(ecElement)
-	hashedGIDInEC := gidMapper(subject)
+	ecElement := b.getABEElement()
 
 	//Merge all attributes as one
 	mergedAttrs := make(map[string][]byte)
@@ -105,53 +155,78 @@ func (b *backend) sysDecrypt(ctx context.Context, req *logical.Request, data *fr
 	for _, attribute := range policyAttrs {
 		if !nonExistentAttrsExist { // No need to check for attributes
 			if sliceContains(gidData.SYSTEM_ATTRIBUTES, attribute) {
-				constructedSystemAttribute, err := b.constructSystemAttribute(ctx, req, attribute, hashedGIDInEC)
+				keyVersion := cts.keyVersion(attribute)
+
+				config, err := b.getKeyConfig(ctx, attribute)
 				if err != nil {
-					return nil, err
+					return nil, nil, err
 				}
-				mergedAttrs[attribute] = constructedSystemAttribute
+				if keyVersion < config.MinDecryptionVersion {
+					return nil, logical.ErrorResponse(fmt.Sprintf("The version %d of the keys of the system attribute %s is below its min_decryption_version %d", keyVersion, attribute, config.MinDecryptionVersion)), nil
+				}
+
+				memoKey := fmt.Sprintf("%s/%d", attribute, keyVersion)
+				if systemAttributeKeys[memoKey] == nil {
+					constructedSystemAttribute, err := b.constructSystemAttribute(ctx, req, attribute, keyVersion, hashedGIDInEC)
+					if err != nil {
+						return nil, nil, err
+					}
+					if constructedSystemAttribute == nil {
+						return nil, logical.ErrorResponse(fmt.Sprintf("Version %d of the keys of the system attribute %s does not exist", keyVersion, attribute)), nil
+					}
+					systemAttributeKeys[memoKey] = constructedSystemAttribute
+				}
+				mergedAttrs[attribute] = systemAttributeKeys[memoKey]
 				mergedAttrsList = append(mergedAttrsList, attribute)
 				continue
 			}
 
 			if gidData.COMMON_ATTRIBUTES[attribute] != nil {
-				mergedAttrs[attribute] = gidData.COMMON_ATTRIBUTES[attribute]
-				mergedAttrsList = append(mergedAttrsList, attribute)
+				key, err := b.cryptogramKey(ctx, gidData, attribute, gidData.COMMON_ATTRIBUTES[attribute], &cts)
+				if err != nil {
+					return nil, nil, err
+				}
+				if key != nil {
+					mergedAttrs[attribute] = key
+					mergedAttrsList = append(mergedAttrsList, attribute)
+				}
 				continue
 			}
 		}
 
 		for _, authorities := range gidData.AUTHORITY_ATTRIBUTES {
 			if authorities[attribute] != nil {
-				mergedAttrs[attribute] = authorities[attribute]
-				mergedAttrsList = append(mergedAttrsList, attribute)
+				key, err := b.cryptogramKey(ctx, gidData, attribute, authorities[attribute], &cts)
+				if err != nil {
+					return nil, nil, err
+				}
+				if key != nil {
+					mergedAttrs[attribute] = key
+					mergedAttrsList = append(mergedAttrsList, attribute)
+				}
 				break
 			}
 		}
 	}
 
-
-	policy := createPolicy(cts.PolicyStr)
-	coeff_list := make(map[string]*pbc.Element)
-
-	policy.getCoefficients(ecElement, coeff_list)
-	policySatisfied, pruned := sub_policy.prune(mergedAttrsList)
-
-	if !policySatisfied {
-		return logical.ErrorResponse(`The given Policy does not satisfy the available attributes`), nil
+	if policySatisfied, _ := sub_policy.prune(mergedAttrsList); !policySatisfied {
+		return nil, logical.ErrorResponse(`The given Policy does not satisfy the available attributes`), nil
 	}
 
-	EggS := ecElement.Pairing().NewGT()
+	// The coefficients of the threshold gates depend on every attribute that takes part in the decryption, the user
+	// ones included, so they are only applied by `decrypt`; every attribute that can take part is computed here
+	if cts.SysDecryptedAttr == nil {
+		cts.SysDecryptedAttr = make(map[string][]byte)
+	}
 
-	for _, attribute := range pruned {
-		attributeCoeff, attributeCoeffIsOk := new(big.Int).SetString(coeff_list[attribute].String(), 10)
-		if !attributeCoeffIsOk {
-			return logical.ErrorResponse(`The System does not utilize any System attributes`), nil
+	for _, attribute := range mergedAttrsList {
+		if cts.C1[attribute] == nil || cts.C2[attribute] == nil || cts.C3[attribute] == nil {
+			continue
 		}
 
 		C1Element := ecElement.Pairing().NewGT().SetBytes(cts.C1[attribute])
-		C2Element := ecElement.Pairing().NewG1().SetBytes(cts.C2[attribute])
-		C3Element := ecElement.Pairing().NewG1().SetBytes(cts.C3[attribute])
+		C2Element := ecElement.Pairing().NewG2().SetBytes(cts.C2[attribute])
+		C3Element := ecElement.Pairing().NewG2().SetBytes(cts.C3[attribute])
 
 		fieldNumBase := ecElement.Pairing().NewGT()
 		fieldNumEl := ecElement.Pairing().NewGT().Pair(hashedGIDInEC, C3Element)
@@ -161,39 +236,40 @@ func (b *backend) sysDecrypt(ctx context.Context, req *logical.Request, data *fr
 
 		fieldDemBase := ecElement.Pairing().NewGT().Pair(gidEC, C2Element)
 
-		div := ecElement.Pairing().NewGT().Set(fieldNumBase).ThenDiv(fieldDemBase)
+		cts.SysDecryptedAttr[attribute] = ecElement.Pairing().NewGT().Set(fieldNumBase).ThenDiv(fieldDemBase).Bytes()
+	}
 
-		EggS = ecElement.Pairing().NewGT().Set(div).ThenPowBig(attributeCoeff)
+	if len(cts.SysDecryptedAttr) == 0 {
+		return nil, logical.ErrorResponse(`None of the given attributes are part of the cryptogram policy`), nil
 	}
 
-	cts.SysDecrypted = EggS.Bytes()
+	// Unless asked otherwise, the cryptogram keeps the envelope it was received with
+	if format = strings.ToLower(format); format != "" {
+		if format != cryptogramFormatJSON && format != cryptogramFormatBinary {
+			return nil, logical.ErrorResponse(fmt.Sprintf("Unsupported format %s (supported: %s, %s)", format, cryptogramFormatJSON, cryptogramFormatBinary)), nil
+		}
+		cts.format = format
+	}
 
-	exported, err := json.Marshal(cts)
+	b64Encoded, err := b.encodeCryptogram(cts)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	b64Encoded := b64.StdEncoding.EncodeToString([]byte(exported))
-
-	return &logical.Response{
-		Data: map[string]interface{}{
-			"b64_enc_data_sysdec": b64Encoded,
-		},
-	}, nil
+	return map[string]interface{}{
+		"b64_enc_data_sysdec": b64Encoded,
+	}, nil, nil
 }
 
-func (b *backend) constructSystemAttribute(ctx context.Context, req *logical.Request, systemAttribute string, hashedGIDInEC *pbc.Element) ([]byte, error) {
-	alphai, yi, err := b.getKeyData(ctx, req, systemAttribute, "", false, true, true)
+// constructSystemAttribute returns the key of the given version of a system attribute for the hashed GID, or nil if that version does not exist
+func (b *backend) constructSystemAttribute(ctx context.Context, req *logical.Request, systemAttribute string, version int, hashedGIDInEC *pbc.Element) ([]byte, error) {
+	keys, err := b.loadAttributeKeys(ctx, SystemAttributes, systemAttribute, version)
 	if err != nil {
 		return nil, errwrap.Wrapf("failed: {{err}}", err)
 	}
-	ecElement := b.getABEElement()
-
-	fieldBase := ecElement.Pairing().NewG1()
-	fieldh := ecElement.Pairing().NewG1().Set(hashedGIDInEC).ThenPowZn(yi)
-	fieldR := ecElement.Pairing().NewG1().Set(ecElement).ThenPowZn(alphai)
-
-	systemAttributeAsBytes := fieldBase.Set(fieldR).ThenMul(fieldh).Bytes()
+	if keys == nil {
+		return nil, nil
+	}
 
-	return systemAttributeAsBytes, nil
+	return b.userAttributeKey(hashedGIDInEC, *keys), nil
 }
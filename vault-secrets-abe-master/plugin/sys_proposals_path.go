@@ -0,0 +1,689 @@
+package abe
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/jsonutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	proposalActionGrant  = "grant"
+	proposalActionRevoke = "revoke"
+
+	proposalStatusOpen     = "open"
+	proposalStatusApproved = "approved"
+	proposalStatusRejected = "rejected"
+	proposalStatusExpired  = "expired"
+
+	defaultProposalTTL = 7 * 24 * time.Hour
+
+	// openSysProposalsPath indexes the open proposals by system attribute, candidate and action
+	openSysProposalsPath = "sysproposals_open"
+)
+
+// The authority acting on a proposal (its proposer or a voter) is the last segment of the path, so that the ACL policies of the
+// mount can tie every authority to its own paths, e.g. `sysproposals/+/vote/<authority>` and `sysproposals/propose/<authority>`
+func pathSysProposals(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: sysProposalsPath + "/?$",
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.listSysProposals,
+					Summary:  "List the system attribute proposals.",
+				},
+			},
+		},
+		{
+			Pattern: sysProposalsPath + "/propose/" + framework.GenericNameRegex("proposer"),
+
+			Fields: map[string]*framework.FieldSchema{
+				"proposer": {
+					Type:        framework.TypeString,
+					Description: "[Required] The authority that makes the proposal",
+				},
+				"system_attribute": {
+					Type:        framework.TypeString,
+					Description: "[Required] The system attribute the proposal is about",
+				},
+				"candidate": {
+					Type:        framework.TypeString,
+					Description: "[Required] The authority to give the system attribute to, or to take it from",
+				},
+				"action": {
+					Type:        framework.TypeString,
+					Description: fmt.Sprintf("What happens to the candidate once the proposal is approved: `%s` (it receives the system attribute) or `%s` (it loses the system attribute, whose keys are rotated)", proposalActionGrant, proposalActionRevoke),
+					Default:     proposalActionGrant,
+				},
+				"ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "How long the proposal stays open for votes (defaults to 7 days)",
+					Default:     int(defaultProposalTTL.Seconds()),
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.createSysProposal,
+					Summary:  "Propose to give a system attribute to an authority, or to take it away.",
+				},
+			},
+		},
+		{
+			Pattern: sysProposalsPath + "/" + framework.GenericNameRegex("id"),
+
+			Fields: map[string]*framework.FieldSchema{
+				"id": {
+					Type:        framework.TypeString,
+					Description: "[Required] The identifier of the proposal",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback:    b.readSysProposal,
+					Summary:     "Read a proposal, its ballots, its history and its tally.",
+					Description: "Reading a proposal changes nothing: it is closed, or carried out, by the next proposal, vote or withdrawal.",
+				},
+			},
+		},
+		{
+			Pattern: sysProposalsPath + "/" + framework.GenericNameRegex("id") + "/vote/" + framework.GenericNameRegex("voter"),
+
+			Fields: map[string]*framework.FieldSchema{
+				"id": {
+					Type:        framework.TypeString,
+					Description: "[Required] The identifier of the proposal",
+				},
+				"voter": {
+					Type:        framework.TypeString,
+					Description: "[Required] The authority that votes",
+				},
+				"approve": {
+					Type:        framework.TypeBool,
+					Description: "Whether the voter approves the proposal",
+					Default:     true,
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.voteSysProposal,
+					Summary:  "Cast or replace the ballot of an authority.",
+				},
+			},
+		},
+		{
+			Pattern: sysProposalsPath + "/" + framework.GenericNameRegex("id") + "/withdraw/" + framework.GenericNameRegex("voter"),
+
+			Fields: map[string]*framework.FieldSchema{
+				"id": {
+					Type:        framework.TypeString,
+					Description: "[Required] The identifier of the proposal",
+				},
+				"voter": {
+					Type:        framework.TypeString,
+					Description: "[Required] The authority that withdraws its ballot",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.withdrawSysProposalVote,
+					Summary:  "Withdraw the ballot of an authority.",
+				},
+			},
+		},
+	}
+}
+
+func sysProposalPath(id string) string {
+	return sysProposalsPath + "/" + id
+}
+
+func (b *backend) loadSysProposal(ctx context.Context, id string) (*sysProposal, error) {
+	out, err := b.storage.Get(ctx, sysProposalPath(id))
+	if err != nil {
+		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+	}
+	if out == nil {
+		return nil, nil
+	}
+
+	var proposal sysProposal
+	if err := jsonutil.DecodeJSON(out.Value, &proposal); err != nil {
+		return nil, errwrap.Wrapf("json decoding failed: {{err}}", err)
+	}
+
+	return &proposal, nil
+}
+
+func (b *backend) storeSysProposal(ctx context.Context, proposal *sysProposal) error {
+	entry, err := logical.StorageEntryJSON(sysProposalPath(proposal.ID), proposal)
+	if err != nil {
+		return errwrap.Wrapf("json encoding failed: {{err}}", err)
+	}
+
+	if err := b.storage.Put(ctx, entry); err != nil {
+		return errwrap.Wrapf("failed to write: {{err}}", err)
+	}
+
+	return nil
+}
+
+func openSysProposalPath(system_attribute string, candidate string, action string) string {
+	return openSysProposalsPath + "/" + system_attribute + "/" + candidate + "/" + action
+}
+
+// indexOpenSysProposal records the proposal as the open one for its change, or forgets it once it is closed
+func (b *backend) indexOpenSysProposal(ctx context.Context, proposal *sysProposal) error {
+	path := openSysProposalPath(proposal.SystemAttribute, proposal.Candidate, proposal.Action)
+
+	if proposal.Status != proposalStatusOpen {
+		if err := b.storage.Delete(ctx, path); err != nil {
+			return errwrap.Wrapf("failed to delete: {{err}}", err)
+		}
+		return nil
+	}
+
+	if err := b.storage.Put(ctx, &logical.StorageEntry{Key: path, Value: []byte(proposal.ID)}); err != nil {
+		return errwrap.Wrapf("failed to write: {{err}}", err)
+	}
+
+	return nil
+}
+
+// openSysProposalIDs returns the identifiers of the open proposals about a system attribute
+func (b *backend) openSysProposalIDs(ctx context.Context, system_attribute string) ([]string, error) {
+	candidates, err := b.storage.List(ctx, openSysProposalsPath+"/"+system_attribute+"/")
+	if err != nil {
+		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+	}
+
+	ids := []string{}
+	for _, candidate := range candidates {
+		actions, err := b.storage.List(ctx, openSysProposalsPath+"/"+system_attribute+"/"+candidate)
+		if err != nil {
+			return nil, errwrap.Wrapf("read failed: {{err}}", err)
+		}
+
+		for _, action := range actions {
+			entry, err := b.storage.Get(ctx, openSysProposalsPath+"/"+system_attribute+"/"+candidate+action)
+			if err != nil {
+				return nil, errwrap.Wrapf("read failed: {{err}}", err)
+			}
+			if entry != nil {
+				ids = append(ids, string(entry.Value))
+			}
+		}
+	}
+
+	return ids, nil
+}
+
+func newSysProposalID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+// tallySysProposal counts the ballots of the registered authorities; the candidate does not vote for itself,
+// so the quorum is computed over the other authorities
+func (b *backend) tallySysProposal(ctx context.Context, proposal *sysProposal) (*proposalTally, error) {
+	sysAttributeInfo, err := b.loadSystemAttributeInfo(ctx, proposal.SystemAttribute)
+	if err != nil {
+		return nil, err
+	}
+	if sysAttributeInfo == nil {
+		sysAttributeInfo = newSystemAttributeInfo(proposal.SystemAttribute)
+	}
+
+	registeredAuthorities, err := b.registeredAuthorities(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	voters := eligibleVoters(registeredAuthorities, proposal.Candidate)
+
+	tally := &proposalTally{
+		RequiredVotes:         sysAttributeInfo.Voting.requiredVotes(voters),
+		RegisteredAuthorities: len(registeredAuthorities),
+		EligibleVoters:        voters,
+	}
+	// e.g. a fixed quorum_count above the number of the other authorities
+	tally.Reachable = tally.RequiredVotes <= tally.EligibleVoters
+
+	for voter, ballot := range proposal.Ballots {
+		if voter == proposal.Candidate || !sliceContains(registeredAuthorities, voter) {
+			continue
+		}
+		if ballot.Approve {
+			tally.Approvals++
+		} else {
+			tally.Rejections++
+		}
+	}
+
+	return tally, nil
+}
+
+// rejected tells whether the proposal can no longer be approved: the quorum exceeds the eligible voters, or too many of them,
+// a majority of them included, voted against it
+func (tally *proposalTally) rejected() bool {
+	return !tally.Reachable || tally.Rejections*2 > tally.EligibleVoters || tally.EligibleVoters-tally.Rejections < tally.RequiredVotes
+}
+
+// evaluateSysProposal expires an open proposal past its deadline, carries it out once it has enough approvals,
+// or rejects it once it can no longer get them. It returns the current tally of the proposal.
+func (b *backend) evaluateSysProposal(ctx context.Context, req *logical.Request, proposal *sysProposal) (*proposalTally, error) {
+	if proposal.Status != proposalStatusOpen {
+		return proposal.Tally, nil
+	}
+
+	tally, err := b.tallySysProposal(ctx, proposal)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	switch {
+	case now.After(proposal.Deadline):
+		proposal.Status = proposalStatusExpired
+	case tally.Reachable && tally.Approvals >= tally.RequiredVotes:
+		if err := b.carryOutSysProposal(ctx, req, proposal); err != nil {
+			return nil, err
+		}
+		proposal.Status = proposalStatusApproved
+	case tally.rejected():
+		proposal.Status = proposalStatusRejected
+	default:
+		return tally, nil
+	}
+
+	proposal.ClosedAt = now
+	proposal.Tally = tally
+	proposal.History = append(proposal.History, proposalEvent{
+		Time:  now,
+		Event: proposal.Status,
+	})
+
+	if err := b.storeSysProposal(ctx, proposal); err != nil {
+		return nil, err
+	}
+
+	if err := b.indexOpenSysProposal(ctx, proposal); err != nil {
+		return nil, err
+	}
+
+	return tally, nil
+}
+
+func (b *backend) carryOutSysProposal(ctx context.Context, req *logical.Request, proposal *sysProposal) error {
+	switch proposal.Action {
+	case proposalActionGrant:
+		_, err := b.grantSystemAttribute(ctx, req, proposal.SystemAttribute, proposal.Candidate)
+		return err
+	case proposalActionRevoke:
+		_, err := b.revokeSystemAttribute(ctx, req, proposal.SystemAttribute, proposal.Candidate)
+		return err
+	default:
+		return fmt.Errorf("unsupported proposal action %q", proposal.Action)
+	}
+}
+
+func sysProposalResponse(proposal *sysProposal, tally *proposalTally) *logical.Response {
+	response := map[string]interface{}{
+		"id":               proposal.ID,
+		"system_attribute": proposal.SystemAttribute,
+		"candidate":        proposal.Candidate,
+		"action":           proposal.Action,
+		"proposer":         proposal.Proposer,
+		"status":           proposal.Status,
+		"created_time":     proposal.CreatedAt.Format(time.RFC3339),
+		"deadline":         proposal.Deadline.Format(time.RFC3339),
+		"ballots":          proposal.Ballots,
+		"history":          proposal.History,
+		"tally":            tally,
+	}
+
+	if proposal.Status != proposalStatusOpen {
+		response["closed_time"] = proposal.ClosedAt.Format(time.RFC3339)
+	}
+
+	return &logical.Response{
+		Data: response,
+	}
+}
+
+func (b *backend) listSysProposals(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	ids, err := b.storage.List(ctx, sysProposalsPath+"/")
+	if err != nil {
+		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+	}
+
+	keyInfo := make(map[string]interface{})
+	for _, id := range ids {
+		proposal, err := b.loadSysProposal(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if proposal == nil {
+			continue
+		}
+
+		status := proposal.Status
+		if status == proposalStatusOpen && time.Now().After(proposal.Deadline) {
+			status = proposalStatusExpired
+		}
+
+		keyInfo[id] = map[string]interface{}{
+			"system_attribute": proposal.SystemAttribute,
+			"candidate":        proposal.Candidate,
+			"action":           proposal.Action,
+			"status":           status,
+		}
+	}
+
+	return logical.ListResponseWithInfo(ids, keyInfo), nil
+}
+
+func (b *backend) createSysProposal(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	system_attribute := strings.ToUpper(data.Get("system_attribute").(string))
+	candidate := data.Get("candidate").(string)
+	proposer := data.Get("proposer").(string)
+	action := strings.ToLower(data.Get("action").(string))
+	ttl := time.Duration(data.Get("ttl").(int)) * time.Second
+
+	if system_attribute == "" || candidate == "" {
+		return logical.ErrorResponse("system_attribute and candidate are required"), nil
+	}
+
+	if ttl <= 0 {
+		return logical.ErrorResponse("The ttl must be positive"), nil
+	}
+
+	b.proposalLock.Lock()
+	defer b.proposalLock.Unlock()
+
+	proposal, resp, err := b.openSysProposal(ctx, req, system_attribute, candidate, action, proposer, ttl)
+	if err != nil || resp != nil {
+		return resp, err
+	}
+
+	tally, err := b.tallySysProposal(ctx, proposal)
+	if err != nil {
+		return nil, err
+	}
+
+	return sysProposalResponse(proposal, tally), nil
+}
+
+// openSysProposal checks and stores a new proposal, unless one is already open for the same change.
+// The caller holds proposalLock.
+func (b *backend) openSysProposal(ctx context.Context, req *logical.Request, system_attribute string, candidate string, action string, proposer string, ttl time.Duration) (*sysProposal, *logical.Response, error) {
+	if action != proposalActionGrant && action != proposalActionRevoke {
+		return nil, logical.ErrorResponse(fmt.Sprintf("Unsupported action %s (supported: %s, %s)", action, proposalActionGrant, proposalActionRevoke)), nil
+	}
+
+	sysAttributeInfo, err := b.loadSystemAttributeInfo(ctx, system_attribute)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sysAttributeInfo == nil {
+		return nil, logical.ErrorResponse(fmt.Sprintf("The system attribute %s does not exist", system_attribute)), nil
+	}
+	// A retired attribute can still be taken away
+	if sysAttributeInfo.Retired && action == proposalActionGrant {
+		return nil, logical.ErrorResponse(fmt.Sprintf("The system attribute %s is retired", system_attribute)), nil
+	}
+
+	registeredAuthorities, err := b.registeredAuthorities(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, authority := range []string{candidate, proposer} {
+		if !sliceContains(registeredAuthorities, authority) {
+			return nil, logical.ErrorResponse(fmt.Sprintf("%s is not a registered authority", authority)), nil
+		}
+	}
+
+	candidateData, err := b.loadGIDData(ctx, req, candidate)
+	if err != nil {
+		return nil, nil, errwrap.Wrapf("Error with GID data: {{err}}", err)
+	}
+	holdsAttribute := sliceContains(candidateData.SYSTEM_ATTRIBUTES, system_attribute)
+	if holdsAttribute && action == proposalActionGrant {
+		return nil, logical.ErrorResponse(fmt.Sprintf("%s already holds the system attribute %s", candidate, system_attribute)), nil
+	}
+	if !holdsAttribute && action == proposalActionRevoke {
+		return nil, logical.ErrorResponse(fmt.Sprintf("%s does not hold the system attribute %s", candidate, system_attribute)), nil
+	}
+
+	// Only one proposal at a time can be open for the same change
+	existing, err := b.findOpenSysProposal(ctx, req, system_attribute, candidate, action)
+	if err != nil {
+		return nil, nil, err
+	}
+	if existing != nil {
+		return nil, logical.ErrorResponse(fmt.Sprintf("The proposal %s is already open for this change", existing.ID)), nil
+	}
+
+	id, err := newSysProposalID()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now().UTC()
+
+	proposal := &sysProposal{
+		ID:              id,
+		SystemAttribute: system_attribute,
+		Candidate:       candidate,
+		Action:          action,
+		Proposer:        proposer,
+		Status:          proposalStatusOpen,
+		CreatedAt:       now,
+		Deadline:        now.Add(ttl),
+		Ballots:         make(map[string]proposalBallot),
+		History: []proposalEvent{
+			{
+				Time:  now,
+				Actor: proposer,
+				Event: "created",
+			},
+		},
+	}
+
+	if err := b.storeSysProposal(ctx, proposal); err != nil {
+		return nil, nil, err
+	}
+
+	if err := b.indexOpenSysProposal(ctx, proposal); err != nil {
+		return nil, nil, err
+	}
+
+	return proposal, nil, nil
+}
+
+// findOpenSysProposal returns the open proposal for a change, if any, closing it on the way if it is past its deadline.
+// The caller holds proposalLock.
+func (b *backend) findOpenSysProposal(ctx context.Context, req *logical.Request, system_attribute string, candidate string, action string) (*sysProposal, error) {
+	entry, err := b.storage.Get(ctx, openSysProposalPath(system_attribute, candidate, action))
+	if err != nil {
+		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	proposal, err := b.loadSysProposal(ctx, string(entry.Value))
+	if err != nil {
+		return nil, err
+	}
+	if proposal == nil {
+		return nil, nil
+	}
+
+	if _, err := b.evaluateSysProposal(ctx, req, proposal); err != nil {
+		return nil, err
+	}
+	if proposal.Status != proposalStatusOpen {
+		return nil, nil
+	}
+
+	return proposal, nil
+}
+
+// readSysProposal reports a proposal as it would be evaluated now, without closing nor carrying it out
+func (b *backend) readSysProposal(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	proposal, err := b.loadSysProposal(ctx, data.Get("id").(string))
+	if err != nil {
+		return nil, err
+	}
+	if proposal == nil {
+		return nil, nil
+	}
+
+	if proposal.Status != proposalStatusOpen {
+		return sysProposalResponse(proposal, proposal.Tally), nil
+	}
+
+	tally, err := b.tallySysProposal(ctx, proposal)
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(proposal.Deadline) {
+		proposal.Status = proposalStatusExpired
+		proposal.ClosedAt = proposal.Deadline
+	} else if tally.Approvals < tally.RequiredVotes && tally.rejected() {
+		proposal.Status = proposalStatusRejected
+		proposal.ClosedAt = time.Now().UTC()
+	}
+
+	return sysProposalResponse(proposal, tally), nil
+}
+
+// castSysProposalBallot returns the change of ballot of a voter approving or rejecting a proposal
+func castSysProposalBallot(voter string, approve bool) func(proposal *sysProposal, now time.Time) *logical.Response {
+	return func(proposal *sysProposal, now time.Time) *logical.Response {
+		if voter == proposal.Candidate {
+			return logical.ErrorResponse("The candidate can not vote on its own proposal")
+		}
+
+		proposal.Ballots[voter] = proposalBallot{
+			Approve: approve,
+			CastAt:  now,
+		}
+
+		// The events of the ballots are not named after the statuses the proposal closes with
+		event := "voted_for"
+		if !approve {
+			event = "voted_against"
+		}
+		proposal.History = append(proposal.History, proposalEvent{
+			Time:  now,
+			Actor: voter,
+			Event: event,
+		})
+
+		return nil
+	}
+}
+
+func (b *backend) voteSysProposal(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	voter := data.Get("voter").(string)
+	approve := data.Get("approve").(bool)
+
+	return b.updateSysProposalBallot(ctx, req, data.Get("id").(string), voter, castSysProposalBallot(voter, approve))
+}
+
+func (b *backend) withdrawSysProposalVote(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	voter := data.Get("voter").(string)
+
+	return b.updateSysProposalBallot(ctx, req, data.Get("id").(string), voter, func(proposal *sysProposal, now time.Time) *logical.Response {
+		if _, ok := proposal.Ballots[voter]; !ok {
+			return logical.ErrorResponse(fmt.Sprintf("%s has not voted on this proposal", voter))
+		}
+
+		delete(proposal.Ballots, voter)
+
+		proposal.History = append(proposal.History, proposalEvent{
+			Time:  now,
+			Actor: voter,
+			Event: "withdrawn",
+		})
+
+		return nil
+	})
+}
+
+// updateSysProposalBallot applies a change of ballot to an open proposal, then evaluates the proposal
+func (b *backend) updateSysProposalBallot(ctx context.Context, req *logical.Request, id string, voter string, update func(proposal *sysProposal, now time.Time) *logical.Response) (*logical.Response, error) {
+	registeredAuthorities, err := b.registeredAuthorities(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !sliceContains(registeredAuthorities, voter) {
+		return logical.ErrorResponse(fmt.Sprintf("%s is not a registered authority", voter)), nil
+	}
+
+	b.proposalLock.Lock()
+	defer b.proposalLock.Unlock()
+
+	proposal, err := b.loadSysProposal(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if proposal == nil {
+		return logical.ErrorResponse(fmt.Sprintf("The proposal %s does not exist", id)), nil
+	}
+
+	tally, resp, err := b.applySysProposalBallot(ctx, req, proposal, update)
+	if err != nil || resp != nil {
+		return resp, err
+	}
+
+	return sysProposalResponse(proposal, tally), nil
+}
+
+// applySysProposalBallot applies a change of ballot to a proposal if it is still open, stores it and evaluates it.
+// The caller holds proposalLock.
+func (b *backend) applySysProposalBallot(ctx context.Context, req *logical.Request, proposal *sysProposal, update func(proposal *sysProposal, now time.Time) *logical.Response) (*proposalTally, *logical.Response, error) {
+	// A proposal past its deadline is closed before the ballot is looked at
+	if _, err := b.evaluateSysProposal(ctx, req, proposal); err != nil {
+		return nil, nil, err
+	}
+	if proposal.Status != proposalStatusOpen {
+		return nil, logical.ErrorResponse(fmt.Sprintf("The proposal %s is %s", proposal.ID, proposal.Status)), nil
+	}
+
+	if resp := update(proposal, time.Now().UTC()); resp != nil {
+		return nil, resp, nil
+	}
+
+	if err := b.storeSysProposal(ctx, proposal); err != nil {
+		return nil, nil, err
+	}
+
+	tally, err := b.evaluateSysProposal(ctx, req, proposal)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return tally, nil, nil
+}
@@ -0,0 +1,434 @@
+package abe
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/jsonutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	quorumSimpleMajority = "simple_majority"
+	quorumSupermajority  = "supermajority"
+	quorumFixed          = "fixed"
+)
+
+func pathSystemAttributes(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: sysAttributesPath + "/?$",
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.listSystemAttributes,
+					Summary:  "List the system attributes.",
+				},
+			},
+		},
+		{
+			Pattern: sysAttributesPath + "/" + framework.GenericNameRegex("name"),
+
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeString,
+					Description: "[Required] The name of the system attribute",
+				},
+				"description": {
+					Type:        framework.TypeString,
+					Description: "What the system attribute stands for",
+				},
+				"quorum": {
+					Type:        framework.TypeString,
+					Description: fmt.Sprintf("The votes an authority needs to receive the attribute: `%s` (more than half of the registered authorities, the candidate aside), `%s` (at least two thirds of them) or `%s` (quorum_count votes)", quorumSimpleMajority, quorumSupermajority, quorumFixed),
+					Default:     quorumSimpleMajority,
+				},
+				"quorum_count": {
+					Type:        framework.TypeInt,
+					Description: fmt.Sprintf("The number of votes required by the `%s` quorum; while it exceeds the number of the other registered authorities, the proposals are rejected", quorumFixed),
+				},
+			},
+
+			ExistenceCheck: b.systemAttributeExistenceCheck,
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.CreateOperation: &framework.PathOperation{
+					Callback: b.createSystemAttribute,
+					Summary:  "Create a system attribute.",
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.updateSystemAttribute,
+					Summary:  "Update the description or the voting configuration of a system attribute.",
+				},
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.describeSystemAttribute,
+					Summary:  "Describe a system attribute and its open proposals.",
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback:    b.retireSystemAttribute,
+					Summary:     "Retire a system attribute.",
+					Description: "A retired attribute can no longer be used in new policies nor be given to authorities. Its keys are kept, so that the existing cryptograms can still be decrypted.",
+				},
+			},
+		},
+		{
+			Pattern: sysAttributesPath + "/" + framework.GenericNameRegex("name") + "/rotate",
+
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeString,
+					Description: "[Required] The name of the system attribute",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback:    b.rotateSystemAttribute,
+					Summary:     "Rotate the keys of a system attribute.",
+					Description: "New cryptograms are encrypted with the new version of the keys. The previous versions are kept, so that the existing cryptograms can still be decrypted by the authorities that hold the attribute.",
+				},
+			},
+		},
+	}
+}
+
+// newSystemAttributeInfo returns the defaults of a system attribute
+func newSystemAttributeInfo(name string) *systemAttributeInfo {
+	return &systemAttributeInfo{
+		Name: name,
+		Voting: votingConfig{
+			Quorum: quorumSimpleMajority,
+		},
+	}
+}
+
+func (config *votingConfig) validate() error {
+	switch config.Quorum {
+	case quorumSimpleMajority, quorumSupermajority:
+		if config.QuorumCount != 0 {
+			return fmt.Errorf("quorum_count is only used by the %s quorum", quorumFixed)
+		}
+	case quorumFixed:
+		if config.QuorumCount < 1 {
+			return fmt.Errorf("the %s quorum requires a positive quorum_count", quorumFixed)
+		}
+	default:
+		return fmt.Errorf("unsupported quorum %q (supported: %s, %s, %s)", config.Quorum, quorumSimpleMajority, quorumSupermajority, quorumFixed)
+	}
+
+	return nil
+}
+
+// requiredVotes returns the number of votes an authority needs out of the authorities eligible to vote for it.
+// A fixed quorum_count may exceed the eligible voters, in which case the proposals to give the attribute are rejected.
+func (config *votingConfig) requiredVotes(eligibleVoters int) int {
+	switch config.Quorum {
+	case quorumSupermajority:
+		return (2*eligibleVoters + 2) / 3
+	case quorumFixed:
+		return config.QuorumCount
+	default:
+		return eligibleVoters/2 + 1
+	}
+}
+
+// eligibleVoters returns the number of registered authorities that vote for a candidate, which does not vote for itself
+func eligibleVoters(registeredAuthorities []string, candidate string) int {
+	if sliceContains(registeredAuthorities, candidate) {
+		return len(registeredAuthorities) - 1
+	}
+	return len(registeredAuthorities)
+}
+
+// registeredAuthorities returns the names of the authorities that have been set up
+func (b *backend) registeredAuthorities(ctx context.Context) ([]string, error) {
+	entries, err := b.getEntries(ctx, []string{AuthoritiesPath})
+	if err != nil {
+		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+	}
+
+	authorities := []string{}
+	for _, entry := range entries {
+		if entry != SystemAttributes && entry != CommonAttributes {
+			authorities = append(authorities, entry)
+		}
+	}
+
+	return authorities, nil
+}
+
+func systemAttributeInfoPath(attribute string) string {
+	return AuthoritiesPath + "/" + SystemAttributes + "/" + attribute + "/" + systemAttributeConfig
+}
+
+// loadSystemAttributeInfo returns the information of a system attribute, or nil if the attribute does not exist
+func (b *backend) loadSystemAttributeInfo(ctx context.Context, attribute string) (*systemAttributeInfo, error) {
+	published, err := b.storage.Get(ctx, AuthoritiesPath+"/"+SystemAttributes+"/"+attribute+"/"+privateAccessor)
+	if err != nil {
+		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+	}
+	if published == nil {
+		return nil, nil
+	}
+
+	info := newSystemAttributeInfo(attribute)
+
+	out, err := b.storage.Get(ctx, systemAttributeInfoPath(attribute))
+	if err != nil {
+		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+	}
+	if out != nil {
+		if err := jsonutil.DecodeJSON(out.Value, info); err != nil {
+			return nil, errwrap.Wrapf("json decoding failed: {{err}}", err)
+		}
+	}
+
+	return info, nil
+}
+
+func (b *backend) storeSystemAttributeInfo(ctx context.Context, info *systemAttributeInfo) error {
+	entry, err := logical.StorageEntryJSON(systemAttributeInfoPath(info.Name), info)
+	if err != nil {
+		return errwrap.Wrapf("json encoding failed: {{err}}", err)
+	}
+
+	if err := b.storage.Put(ctx, entry); err != nil {
+		return errwrap.Wrapf("failed to write: {{err}}", err)
+	}
+
+	return nil
+}
+
+// addSystemAttribute generates the keys of a new system attribute and stores its information
+func (b *backend) addSystemAttribute(ctx context.Context, info *systemAttributeInfo) error {
+	info.CreatedAt = time.Now().UTC()
+
+	if err := b.storeSystemAttributeKeys(ctx, info.Name, initialKeyVersion); err != nil {
+		return err
+	}
+
+	return b.storeSystemAttributeInfo(ctx, info)
+}
+
+func (b *backend) systemAttributeExistenceCheck(ctx context.Context, req *logical.Request, data *framework.FieldData) (bool, error) {
+	info, err := b.loadSystemAttributeInfo(ctx, strings.ToUpper(data.Get("name").(string)))
+	if err != nil {
+		return false, err
+	}
+
+	return info != nil, nil
+}
+
+func (b *backend) listSystemAttributes(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	attributes, err := b.getEntries(ctx, []string{AuthoritiesPath, SystemAttributes})
+	if err != nil {
+		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+	}
+
+	keyInfo := make(map[string]interface{})
+	for _, attribute := range attributes {
+		info, err := b.loadSystemAttributeInfo(ctx, attribute)
+		if err != nil {
+			return nil, err
+		}
+		if info == nil {
+			continue
+		}
+
+		keyInfo[attribute] = map[string]interface{}{
+			"description": info.Description,
+			"retired":     info.Retired,
+		}
+	}
+
+	return logical.ListResponseWithInfo(attributes, keyInfo), nil
+}
+
+func (b *backend) createSystemAttribute(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToUpper(data.Get("name").(string))
+
+	if !plainNameRegex.MatchString(name) {
+		return logical.ErrorResponse(fmt.Sprintf("Invalid system attribute name %q", name)), nil
+	}
+
+	// Common and system attributes share the same names in the policies
+	commonAttributes, err := b.getEntries(ctx, []string{AuthoritiesPath, CommonAttributes})
+	if err != nil {
+		return nil, errwrap.Wrapf("read failed: {{err}}", err)
+	}
+	if sliceContains(commonAttributes, name) {
+		return logical.ErrorResponse(fmt.Sprintf("A common attribute named %s already exists", name)), nil
+	}
+
+	info := newSystemAttributeInfo(name)
+	info.Description = data.Get("description").(string)
+	info.Voting.Quorum = strings.ToLower(data.Get("quorum").(string))
+	info.Voting.QuorumCount = data.Get("quorum_count").(int)
+
+	if err := info.Voting.validate(); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if err := b.addSystemAttribute(ctx, info); err != nil {
+		return nil, errwrap.Wrapf("failed to create the system attribute: {{err}}", err)
+	}
+
+	return b.describeSystemAttribute(ctx, req, data)
+}
+
+func (b *backend) updateSystemAttribute(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToUpper(data.Get("name").(string))
+
+	info, err := b.loadSystemAttributeInfo(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return logical.ErrorResponse(fmt.Sprintf("The system attribute %s does not exist", name)), nil
+	}
+	if info.Retired {
+		return logical.ErrorResponse(fmt.Sprintf("The system attribute %s is retired", name)), nil
+	}
+
+	if description, ok := data.GetOk("description"); ok {
+		info.Description = description.(string)
+	}
+	if quorum, ok := data.GetOk("quorum"); ok {
+		info.Voting.Quorum = strings.ToLower(quorum.(string))
+		info.Voting.QuorumCount = 0
+	}
+	if quorumCount, ok := data.GetOk("quorum_count"); ok {
+		info.Voting.QuorumCount = quorumCount.(int)
+	}
+
+	if err := info.Voting.validate(); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if err := b.storeSystemAttributeInfo(ctx, info); err != nil {
+		return nil, err
+	}
+
+	return b.describeSystemAttribute(ctx, req, data)
+}
+
+func (b *backend) describeSystemAttribute(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToUpper(data.Get("name").(string))
+
+	info, err := b.loadSystemAttributeInfo(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, nil
+	}
+
+	// The votes are cast on the proposals of the attribute
+	ids, err := b.openSysProposalIDs(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	openProposals := []string{}
+	for _, id := range ids {
+		proposal, err := b.loadSysProposal(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if proposal != nil && proposal.SystemAttribute == name && proposal.Status == proposalStatusOpen && !time.Now().After(proposal.Deadline) {
+			openProposals = append(openProposals, id)
+		}
+	}
+
+	attributesList, err := b.allAttributesPutTogether(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Retired attributes are not indexed
+	keyVersion := 0
+	if published, ok := attributesList[name]; ok {
+		keyVersion = published.keyVersion()
+	}
+
+	response := map[string]interface{}{
+		"name":         info.Name,
+		"description":  info.Description,
+		"quorum":       info.Voting.Quorum,
+		"quorum_count": info.Voting.QuorumCount,
+		"retired":      info.Retired,
+		"proposals":    openProposals,
+	}
+
+	if keyVersion != 0 {
+		response["key_version"] = keyVersion
+	}
+
+	if !info.CreatedAt.IsZero() {
+		response["created_time"] = info.CreatedAt.Format(time.RFC3339)
+	}
+	if info.Retired {
+		response["retired_time"] = info.RetiredAt.Format(time.RFC3339)
+	}
+
+	return &logical.Response{
+		Data: response,
+	}, nil
+}
+
+func (b *backend) retireSystemAttribute(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToUpper(data.Get("name").(string))
+
+	info, err := b.loadSystemAttributeInfo(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil || info.Retired {
+		return nil, nil
+	}
+
+	info.Retired = true
+	info.RetiredAt = time.Now().UTC()
+
+	if err := b.storeSystemAttributeInfo(ctx, info); err != nil {
+		return nil, err
+	}
+
+	// New cryptograms can no longer use the attribute
+	b.unindexAttributeKey(name)
+
+	return nil, nil
+}
+
+func (b *backend) rotateSystemAttribute(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToUpper(data.Get("name").(string))
+
+	info, err := b.loadSystemAttributeInfo(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return logical.ErrorResponse(fmt.Sprintf("The system attribute %s does not exist", name)), nil
+	}
+	if info.Retired {
+		return logical.ErrorResponse(fmt.Sprintf("The system attribute %s is retired", name)), nil
+	}
+
+	defer b.lockAttributes(name)()
+
+	keys, err := b.rotateAttributeKeys(ctx, SystemAttributes, name, true)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to rotate the system attribute: {{err}}", err)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"name":        name,
+			"key_version": keys.Version,
+		},
+	}, nil
+}
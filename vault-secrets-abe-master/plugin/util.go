@@ -1,5 +1,7 @@
 package abe
 
+import "time"
+
 const (
 	//coreABEGroupKeyPath is where the BASE EC element is stored
 	coreABEGroupKeyPath = "config/ecelement"
@@ -13,17 +15,26 @@ const (
 	keypathGids               = "/GIDS/"
 	keygenpath                = "keygen"
 	systemattributekeygenpath = "syskeygen"
-	majorityConcernsDir       = "majority_concerns"
 	abecache                  = "ecData"
-	privateAccessor            = "PRIVATE_DATA"
-	publicAccessor           = "PUBLISHED_DATA"
+	abeParamsHashCache        = "ecParamsHash"
+	abeG2Cache                = "ecG2Data"
+	privateAccessor           = "PRIVATE_DATA"
+	publicAccessor            = "PUBLISHED_DATA"
 	CommonAttributes          = "COMMON_AUTHORITIES_ATTRIBUTES"
 	CommonAttributesEndpoint  = "commonattributes"
+	systemAttributeConfig     = "CONFIG"
+	keyVersionsDir            = "VERSIONS"
+	sysAttributesPath         = "sysattributes"
+	sysProposalsPath          = "sysproposals"
 )
 
 type encodedG struct {
 	EncodedG []byte
 	Params   []byte
+	// ParamSet is empty for the mounts initialized before the parameters could be chosen (see paramSetA512)
+	ParamSet string `json:",omitempty"`
+	// EncodedH is the generator of G2, only set for asymmetric pairings (symmetric ones use EncodedG)
+	EncodedH []byte `json:",omitempty"`
 }
 
 type mergedAttributes struct {
@@ -31,14 +42,65 @@ type mergedAttributes struct {
 	isCommon  bool
 }
 
-type majorityConcernsInfo struct {
-	Attribute map[string]map[string][]string
+// votingConfig describes how many authorities must vote for an authority before it receives a system attribute
+type votingConfig struct {
+	Quorum      string `json:"quorum"`
+	QuorumCount int    `json:"quorum_count,omitempty"`
+}
+
+// systemAttributeInfo is stored next to the keys of a system attribute. System attributes created before their
+// management existed have none, and use the defaults of newSystemAttributeInfo.
+type systemAttributeInfo struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Voting      votingConfig `json:"voting"`
+	Retired     bool         `json:"retired"`
+	CreatedAt   time.Time    `json:"created_at"`
+	RetiredAt   time.Time    `json:"retired_at,omitempty"`
+}
+
+type proposalBallot struct {
+	Approve bool      `json:"approve"`
+	CastAt  time.Time `json:"cast_at"`
+}
+
+type proposalEvent struct {
+	Time  time.Time `json:"time"`
+	Actor string    `json:"actor"`
+	Event string    `json:"event"`
+}
+
+type proposalTally struct {
+	Approvals             int  `json:"approvals"`
+	Rejections            int  `json:"rejections"`
+	RequiredVotes         int  `json:"required_votes"`
+	RegisteredAuthorities int  `json:"registered_authorities"`
+	EligibleVoters        int  `json:"eligible_voters"`
+	Reachable             bool `json:"reachable"`
+}
+
+// sysProposal is a vote on a change of the system attributes of an authority (the candidate)
+type sysProposal struct {
+	ID              string                    `json:"id"`
+	SystemAttribute string                    `json:"system_attribute"`
+	Candidate       string                    `json:"candidate"`
+	Action          string                    `json:"action"`
+	Proposer        string                    `json:"proposer"`
+	Status          string                    `json:"status"`
+	CreatedAt       time.Time                 `json:"created_at"`
+	Deadline        time.Time                 `json:"deadline"`
+	ClosedAt        time.Time                 `json:"closed_at,omitempty"`
+	Ballots         map[string]proposalBallot `json:"ballots"`
+	History         []proposalEvent           `json:"history"`
+	// Tally is the final tally, set once the proposal is closed
+	Tally *proposalTally `json:"tally,omitempty"`
 }
 
 type keysData struct {
 	Attribute string `json:"Attribute"`
 	Alphai    []byte `json:"alphai"`
 	Yi        []byte `json:"yi"`
+	Version   int    `json:"Version,omitempty"`
 }
 
 type keysDataAsResponse struct {
@@ -52,16 +114,34 @@ type gidData struct {
 	COMMON_ATTRIBUTES    map[string][]byte            `json:"COMMON_ATTRIBUTES"`
 	AUTHORITY_ATTRIBUTES map[string]map[string][]byte `json:"AUTHORITY_ATTRIBUTES"`
 	// SYSTEM_ATTRIBUTES    map[string][]byte            `json:"SYSTEM_ATTRIBUTES"`
-	SYSTEM_ATTRIBUTES    []string `json:"SYSTEM_ATTRIBUTES"`
+	SYSTEM_ATTRIBUTES []string `json:"SYSTEM_ATTRIBUTES"`
+	// KEY_VERSIONS holds the version of the keys above, by attribute as named in the policies (the initial version when missing)
+	KEY_VERSIONS map[string]int `json:"KEY_VERSIONS,omitempty"`
+	// PREVIOUS_KEYS holds the keys of the previous versions that can still decrypt, by attribute as named in the policies and version
+	PREVIOUS_KEYS map[string]map[int][]byte `json:"PREVIOUS_KEYS,omitempty"`
 }
 
+type cryptogramHeader struct {
+	Version     int            `json:"Version"`
+	Cipher      string         `json:"Cipher"`
+	KDF         string         `json:"KDF"`
+	KDFSalt     []byte         `json:"KDFSalt,omitempty"`
+	ParamsHash  []byte         `json:"ParamsHash"`
+	KeyVersions map[string]int `json:"KeyVersions"`
+}
+
+// SysDecryptedAttr holds the part of every system attribute `sysdecrypt` computed, SysDecrypted being their legacy, already combined form
 type cryptogram struct {
+	Header           *cryptogramHeader `json:"Header,omitempty"`
 	C0               []byte            `json:"C0"`
 	C1               map[string][]byte `json:"C1"`
 	C2               map[string][]byte `json:"C2"`
 	C3               map[string][]byte `json:"C3"`
 	SysDecrypted     []byte            `json:"SysDecrypted,omitempty"`
+	SysDecryptedAttr map[string][]byte `json:"SysDecryptedAttributes,omitempty"`
 	EncryptedMessage []byte            `json:"EncryptedMessage"`
 	CipherIV         []byte            `json:"CipherIV"`
 	PolicyStr        string            `json:"Policy"`
+
+	format string
 }
@@ -0,0 +1,353 @@
+// Package stream implements a segmented AEAD format to encrypt arbitrarily large streams under a single data key,
+// such as the one returned by the `datakey` endpoint of the plugin.
+//
+// A stream starts with a header that records the format version, the cipher, the chunk size and a random salt.
+// The key of the stream is derived from the data key and the salt with HKDF-SHA256, and the plaintext is then split
+// in chunks of a fixed size that are sealed independently. The nonce of every chunk is built from its position in
+// the stream and a flag set only for the last chunk, so that reordered, dropped or truncated chunks fail the
+// authentication. The header and the caller's additional data (e.g. the ABE cryptogram that wraps the data key)
+// are authenticated with every chunk.
+package stream
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	CipherAES256GCM        = "aes256-gcm96"
+	CipherChaCha20Poly1305 = "chacha20-poly1305"
+
+	DefaultCipher    = CipherAES256GCM
+	DefaultChunkSize = 64 * 1024
+	MaxChunkSize     = 16 * 1024 * 1024
+
+	// KeySize is the size of the data key expected by NewWriter and NewReader
+	KeySize = 32
+
+	formatVersion = 1
+	saltSize      = 32
+	nonceSize     = 12
+	kdfInfo       = "vault-secrets-abe stream key v1"
+)
+
+var magic = []byte("ABES")
+
+var (
+	// ErrAuthentication is returned when a chunk has been modified, reordered or does not belong to the stream
+	ErrAuthentication = errors.New("stream: chunk could not be authenticated")
+
+	// ErrTruncated is returned when the stream ends before its final chunk
+	ErrTruncated = errors.New("stream: truncated stream")
+
+	// ErrClosed is returned when writing to a closed Writer
+	ErrClosed = errors.New("stream: write to closed writer")
+)
+
+var cipherIDs = map[string]byte{
+	CipherAES256GCM:        1,
+	CipherChaCha20Poly1305: 2,
+}
+
+type header struct {
+	cipherType string
+	chunkSize  int
+	salt       []byte
+}
+
+func (h *header) marshal() []byte {
+	var buf bytes.Buffer
+	buf.Write(magic)
+	buf.WriteByte(formatVersion)
+	buf.WriteByte(cipherIDs[h.cipherType])
+
+	var chunkSize [4]byte
+	binary.BigEndian.PutUint32(chunkSize[:], uint32(h.chunkSize))
+	buf.Write(chunkSize[:])
+	buf.Write(h.salt)
+
+	return buf.Bytes()
+}
+
+func readHeader(src io.Reader) (*header, []byte, error) {
+	raw := make([]byte, len(magic)+2+4+saltSize)
+	if _, err := io.ReadFull(src, raw); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil, ErrTruncated
+		}
+		return nil, nil, err
+	}
+
+	if !bytes.Equal(raw[:len(magic)], magic) {
+		return nil, nil, errors.New("stream: not an encrypted stream")
+	}
+
+	if raw[len(magic)] != formatVersion {
+		return nil, nil, fmt.Errorf("stream: unsupported format version %d", raw[len(magic)])
+	}
+
+	h := &header{}
+	for cipherType, id := range cipherIDs {
+		if id == raw[len(magic)+1] {
+			h.cipherType = cipherType
+		}
+	}
+	if h.cipherType == "" {
+		return nil, nil, fmt.Errorf("stream: unsupported cipher %d", raw[len(magic)+1])
+	}
+
+	h.chunkSize = int(binary.BigEndian.Uint32(raw[len(magic)+2:]))
+	if h.chunkSize <= 0 || h.chunkSize > MaxChunkSize {
+		return nil, nil, fmt.Errorf("stream: invalid chunk size %d", h.chunkSize)
+	}
+
+	h.salt = raw[len(magic)+6:]
+
+	return h, raw, nil
+}
+
+// newAEAD derives the key of the stream from the data key and the salt of the header
+func newAEAD(cipherType string, key []byte, salt []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("stream: invalid key size %d, expected %d", len(key), KeySize)
+	}
+
+	streamKey := make([]byte, KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte(kdfInfo)), streamKey); err != nil {
+		return nil, err
+	}
+
+	switch cipherType {
+	case CipherAES256GCM:
+		block, err := aes.NewCipher(streamKey)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CipherChaCha20Poly1305:
+		return chacha20poly1305.New(streamKey)
+	default:
+		return nil, fmt.Errorf("stream: unsupported cipher %q", cipherType)
+	}
+}
+
+// chunkNonce encodes the position of the chunk in the first 11 bytes and the final-chunk flag in the last one
+func chunkNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if final {
+		nonce[nonceSize-1] = 1
+	}
+	return nonce
+}
+
+// Writer encrypts the data written to it into the segmented format. Close must be called to write the final chunk.
+type Writer struct {
+	dst       io.Writer
+	aead      cipher.AEAD
+	aad       []byte
+	buf       []byte
+	chunkSize int
+	counter   uint64
+	closed    bool
+}
+
+// NewWriter writes the header of the stream to dst and returns a Writer that encrypts under the data key.
+// An empty cipherType selects DefaultCipher and a chunkSize of 0 selects DefaultChunkSize. The additionalData is
+// authenticated but not written to the stream: the same value has to be passed to NewReader.
+func NewWriter(dst io.Writer, key []byte, cipherType string, chunkSize int, additionalData []byte) (*Writer, error) {
+	if cipherType == "" {
+		cipherType = DefaultCipher
+	}
+	if chunkSize == 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if chunkSize < 0 || chunkSize > MaxChunkSize {
+		return nil, fmt.Errorf("stream: invalid chunk size %d", chunkSize)
+	}
+	if _, ok := cipherIDs[cipherType]; !ok {
+		return nil, fmt.Errorf("stream: unsupported cipher %q", cipherType)
+	}
+
+	h := &header{
+		cipherType: cipherType,
+		chunkSize:  chunkSize,
+		salt:       make([]byte, saltSize),
+	}
+	if _, err := io.ReadFull(rand.Reader, h.salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(cipherType, key, h.salt)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := h.marshal()
+	if _, err := dst.Write(raw); err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		dst:       dst,
+		aead:      aead,
+		aad:       append(raw, additionalData...),
+		buf:       make([]byte, 0, chunkSize),
+		chunkSize: chunkSize,
+	}, nil
+}
+
+// Write buffers p and seals every complete chunk. A full chunk is only sealed once more data arrives, since the
+// last chunk of the stream has to be sealed as final.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrClosed
+	}
+
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) == w.chunkSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(w.buf[len(w.buf):w.chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+// Close seals the final chunk. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	return w.seal(true)
+}
+
+func (w *Writer) seal(final bool) error {
+	if w.counter == ^uint64(0) {
+		return errors.New("stream: too many chunks")
+	}
+
+	sealed := w.aead.Seal(nil, chunkNonce(w.counter, final), w.buf, w.aad)
+	if _, err := w.dst.Write(sealed); err != nil {
+		return err
+	}
+
+	w.counter++
+	w.buf = w.buf[:0]
+
+	return nil
+}
+
+// Reader decrypts a stream produced by a Writer. Data is only returned once its chunk has been authenticated.
+type Reader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	aad     []byte
+	sealed  []byte
+	pending []byte
+	counter uint64
+	done    bool
+}
+
+// NewReader reads the header of the stream from src and returns a Reader that decrypts with the data key.
+func NewReader(src io.Reader, key []byte, additionalData []byte) (*Reader, error) {
+	h, raw, err := readHeader(src)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(h.cipherType, key, h.salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reader{
+		src:  src,
+		aead: aead,
+		aad:  append(raw, additionalData...),
+		// One extra byte tells whether another chunk follows the current one
+		sealed: make([]byte, 0, h.chunkSize+aead.Overhead()+1),
+	}, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+
+	return n, nil
+}
+
+func (r *Reader) open() error {
+	n, err := io.ReadFull(r.src, r.sealed[len(r.sealed):cap(r.sealed)])
+	r.sealed = r.sealed[:len(r.sealed)+n]
+
+	final := false
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		final = true
+	default:
+		return err
+	}
+
+	chunk := r.sealed
+	if !final {
+		chunk = r.sealed[:len(r.sealed)-1]
+	}
+
+	if len(chunk) < r.aead.Overhead() {
+		return ErrTruncated
+	}
+
+	plaintext, err := r.aead.Open(nil, chunkNonce(r.counter, final), chunk, r.aad)
+	if err != nil {
+		if final {
+			// A valid non-final chunk at the end of the stream means that the final chunks were cut off
+			if _, err := r.aead.Open(nil, chunkNonce(r.counter, false), chunk, r.aad); err == nil {
+				return ErrTruncated
+			}
+		}
+		return ErrAuthentication
+	}
+
+	r.counter++
+	r.pending = plaintext
+
+	if final {
+		r.done = true
+		r.sealed = r.sealed[:0]
+	} else {
+		last := r.sealed[len(r.sealed)-1]
+		r.sealed = append(r.sealed[:0], last)
+	}
+
+	return nil
+}
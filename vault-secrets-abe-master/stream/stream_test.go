@@ -0,0 +1,210 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+const testChunkSize = 32
+
+var testCiphers = []string{CipherAES256GCM, CipherChaCha20Poly1305}
+
+func testKey(t *testing.T) []byte {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testPlaintext(t *testing.T, size int) []byte {
+	plaintext := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, plaintext); err != nil {
+		t.Fatal(err)
+	}
+	return plaintext
+}
+
+// encrypt writes the plaintext in uneven pieces, so that the chunks are not aligned with the writes
+func encrypt(t *testing.T, key []byte, cipherType string, plaintext []byte, additionalData []byte) []byte {
+	var sealed bytes.Buffer
+
+	w, err := NewWriter(&sealed, key, cipherType, testChunkSize, additionalData)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+
+	for remaining, piece := plaintext, 1; len(remaining) > 0; piece = piece*2 + 1 {
+		if piece > len(remaining) {
+			piece = len(remaining)
+		}
+		if _, err := w.Write(remaining[:piece]); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		remaining = remaining[piece:]
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	return sealed.Bytes()
+}
+
+func decrypt(sealed []byte, key []byte, additionalData []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(sealed), key, additionalData)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// headerSize and sealedChunkSize locate the chunks of a stream encrypted with testChunkSize
+func headerSize() int {
+	return len(magic) + 2 + 4 + saltSize
+}
+
+func sealedChunkSize() int {
+	return testChunkSize + 16
+}
+
+func TestRoundTrip(t *testing.T) {
+	sizes := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"one byte", 1},
+		{"exactly one chunk", testChunkSize},
+		{"one chunk and one byte", testChunkSize + 1},
+		{"exactly three chunks", 3 * testChunkSize},
+		{"several chunks", 3*testChunkSize + 5},
+	}
+
+	for _, cipherType := range testCiphers {
+		for _, test := range sizes {
+			t.Run(cipherType+"/"+test.name, func(t *testing.T) {
+				key := testKey(t)
+				plaintext := testPlaintext(t, test.size)
+				additionalData := []byte("cryptogram")
+
+				sealed := encrypt(t, key, cipherType, plaintext, additionalData)
+
+				// A plaintext that ends on a chunk boundary has its last full chunk sealed as final, an empty one is sealed on its own
+				chunks := (test.size + testChunkSize - 1) / testChunkSize
+				if chunks == 0 {
+					chunks = 1
+				}
+				if expected := headerSize() + test.size + chunks*(sealedChunkSize()-testChunkSize); len(sealed) != expected {
+					t.Fatalf("sealed stream is %d bytes long, want %d", len(sealed), expected)
+				}
+
+				decrypted, err := decrypt(sealed, key, additionalData)
+				if err != nil {
+					t.Fatalf("decrypt: %v", err)
+				}
+				if !bytes.Equal(decrypted, plaintext) {
+					t.Fatalf("decrypted %d bytes that differ from the %d bytes of plaintext", len(decrypted), len(plaintext))
+				}
+			})
+		}
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	for _, cipherType := range testCiphers {
+		t.Run(cipherType, func(t *testing.T) {
+			key := testKey(t)
+			sealed := encrypt(t, key, cipherType, testPlaintext(t, 3*testChunkSize+5), nil)
+
+			cuts := map[string]int{
+				"within the header":        headerSize() - 1,
+				"after the header":         headerSize(),
+				"after the first chunk":    headerSize() + sealedChunkSize(),
+				"after the third chunk":    headerSize() + 3*sealedChunkSize(),
+				"within the second chunk":  headerSize() + sealedChunkSize() + 3,
+				"before the last tag ends": len(sealed) - 1,
+			}
+
+			for name, cut := range cuts {
+				_, err := decrypt(sealed[:cut], key, nil)
+				if name == "within the second chunk" || name == "before the last tag ends" {
+					// A partial chunk can not be told apart from a modified one
+					if err != ErrAuthentication && err != ErrTruncated {
+						t.Errorf("%s: got %v, want an authentication or truncation error", name, err)
+					}
+					continue
+				}
+				if err != ErrTruncated {
+					t.Errorf("%s: got %v, want %v", name, err, ErrTruncated)
+				}
+			}
+		})
+	}
+}
+
+func TestTampered(t *testing.T) {
+	for _, cipherType := range testCiphers {
+		t.Run(cipherType, func(t *testing.T) {
+			key := testKey(t)
+			additionalData := []byte("cryptogram")
+			sealed := encrypt(t, key, cipherType, testPlaintext(t, 3*testChunkSize+5), additionalData)
+
+			chunk := func(i int) []byte {
+				start := headerSize() + i*sealedChunkSize()
+				return sealed[start : start+sealedChunkSize()]
+			}
+
+			reordered := append([]byte{}, sealed[:headerSize()]...)
+			reordered = append(reordered, chunk(1)...)
+			reordered = append(reordered, chunk(0)...)
+			reordered = append(reordered, sealed[headerSize()+2*sealedChunkSize():]...)
+
+			modified := append([]byte{}, sealed...)
+			modified[headerSize()+sealedChunkSize()+1] ^= 1
+
+			modifiedHeader := append([]byte{}, sealed...)
+			modifiedHeader[headerSize()-1] ^= 1
+
+			// The last chunk sealed as the final one can not stand in for a chunk in the middle
+			dropped := append([]byte{}, sealed[:headerSize()+sealedChunkSize()]...)
+			dropped = append(dropped, sealed[headerSize()+3*sealedChunkSize():]...)
+
+			streams := map[string][]byte{
+				"reordered chunks": reordered,
+				"modified chunk":   modified,
+				"modified salt":    modifiedHeader,
+				"dropped chunks":   dropped,
+			}
+
+			for name, stream := range streams {
+				if _, err := decrypt(stream, key, additionalData); err != ErrAuthentication {
+					t.Errorf("%s: got %v, want %v", name, err, ErrAuthentication)
+				}
+			}
+
+			if _, err := decrypt(sealed, key, []byte("another cryptogram")); err != ErrAuthentication {
+				t.Errorf("mismatched additional data: got %v, want %v", err, ErrAuthentication)
+			}
+
+			if _, err := decrypt(sealed, testKey(t), additionalData); err != ErrAuthentication {
+				t.Errorf("another key: got %v, want %v", err, ErrAuthentication)
+			}
+		})
+	}
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	w, err := NewWriter(io.Discard, make([]byte, KeySize), "", testChunkSize, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("data")); err != ErrClosed {
+		t.Fatalf("got %v, want %v", err, ErrClosed)
+	}
+}